@@ -0,0 +1,354 @@
+/*
+Package apng creates and reads animated PNG (APNG) images with a palette generated by the imagequant library.
+
+Frames are cropped to the region that changed since the previous frame. Frames that only add opaque pixels are
+remapped with the previous frame as background (see imagequant's SetImageBackground), so that unchanged pixels become
+transparent and compress well.
+*/
+package apng
+
+import (
+  "fmt"
+  "image"
+  "image/color"
+  "image/draw"
+  "time"
+
+  "github.com/InfinityTools/go-imagequant"
+  "github.com/InfinityTools/go-imagequant/internal/canvas"
+  "github.com/InfinityTools/go-imagequant/internal/palette"
+)
+
+
+// DisposeOp defines how the frame region is treated before the next frame is rendered.
+type DisposeOp byte
+
+const (
+  DisposeNone       DisposeOp = 0 // The canvas is left unchanged.
+  DisposeBackground DisposeOp = 1 // The frame region is cleared to fully transparent black.
+  DisposePrevious   DisposeOp = 2 // The frame region is reverted to its content before the frame was rendered.
+)
+
+// BlendOp defines how the frame is rendered onto the canvas.
+type BlendOp byte
+
+const (
+  BlendSource BlendOp = 0 // The frame replaces the content of the frame region.
+  BlendOver   BlendOp = 1 // The frame is composited onto the content of the frame region.
+)
+
+// PaletteMode defines how the palette of the animation is generated. APNG images use a single palette for all frames.
+type PaletteMode int
+
+const (
+  // PaletteShared generates a palette from the colors of all frames.
+  PaletteShared PaletteMode = iota
+  // PalettePerFrame quantizes each frame separately and combines the colors of all frames into a single palette.
+  // The available palette entries are distributed among the frames.
+  PalettePerFrame
+)
+
+// Frame is a single frame of an animation.
+type Frame struct {
+  Image     *image.Paletted // Frame pixels. The image bounds define the frame region on the canvas.
+  DelayNum  uint16          // Numerator of the display duration in seconds
+  DelayDen  uint16          // Denominator of the display duration in seconds. 0 is treated as 100.
+  Dispose   DisposeOp
+  Blend     BlendOp
+}
+
+// APNG contains the frames of an animated PNG image.
+type APNG struct {
+  Width, Height int
+  Palette       color.Palette // Palette shared by all frames
+  LoopCount     int           // Number of times the animation is played. 0 plays the animation indefinitely.
+  Frames        []Frame
+}
+
+// Options defines optional parameters of Build.
+type Options struct {
+  // Attributes defines the quantization settings. Default settings are used if nil.
+  // The object is never modified by Build.
+  Attributes      *imagequant.Attributes
+  // DitheringLevel is used when remapping frames. See SetDitheringLevel. The zero value disables dithering, while the
+  // library default is 1.0.
+  DitheringLevel  float32
+  // Palette defines how the palette of the animation is generated.
+  Palette         PaletteMode
+  // LoopCount is passed to the LoopCount field of the APNG structure.
+  LoopCount       int
+}
+
+// Used internally. Encoding parameters of a single frame, determined by comparing the source frames.
+type framePlan struct {
+  index     int             // index of the source frame
+  rect      image.Rectangle // region of the canvas covered by the frame
+  dispose   DisposeOp
+  blend     BlendOp
+  delay     time.Duration
+}
+
+// Used internally. The fully transparent color reserved for frames that are blended over the canvas.
+var transparent = imagequant.Color{ R: 0, G: 0, B: 0, A: 0 }
+
+
+// Returns the display duration of the frame.
+func (f *Frame) Delay() time.Duration {
+  den := time.Duration(f.DelayDen)
+  if den == 0 { den = 100 }
+  return time.Duration(f.DelayNum) * time.Second / den
+}
+
+// Sets the display duration of the frame. The duration is rounded to the nearest fraction that can be represented.
+func (f *Frame) SetDelay(d time.Duration) {
+  for _, den := range []time.Duration{ 1000, 100, 10, 1 } {
+    num := (d * den + time.Second / 2) / time.Second
+    if num <= 0xffff || den == 1 {
+      if num > 0xffff { num = 0xffff }
+      if num < 0 { num = 0 }
+      f.DelayNum, f.DelayDen = uint16(num), uint16(den)
+      return
+    }
+  }
+}
+
+// Renders all frames and returns the content of the canvas after each frame has been rendered.
+func (a *APNG) Render() []*image.NRGBA {
+  retVal := make([]*image.NRGBA, len(a.Frames))
+  screen := image.NewNRGBA(image.Rect(0, 0, a.Width, a.Height))
+  for i, f := range a.Frames {
+    r := f.Image.Bounds()
+    var prev *image.NRGBA
+    if f.Dispose == DisposePrevious { prev = canvas.Clone(screen) }
+    op := draw.Src
+    if f.Blend == BlendOver { op = draw.Over }
+    draw.Draw(screen, r, f.Image, r.Min, op)
+    retVal[i] = canvas.Clone(screen)
+    switch f.Dispose {
+    case DisposeBackground:
+      draw.Draw(screen, r, image.Transparent, image.Point{}, draw.Src)
+    case DisposePrevious:
+      screen = prev
+    }
+  }
+  return retVal
+}
+
+
+// Creates an animation from the given frames. delays defines the display duration of each frame.
+//
+// All frames must have the same size. Consecutive identical frames are merged into a single frame.
+// Default options are used if opts is nil.
+//
+// Returns an error wrapping imagequant.ErrValueOutOfRange if frames is empty, the number of delays does not match the
+// number of frames, the frames differ in size or the frames need more than 256 colors in mode PalettePerFrame.
+func Build(frames []image.Image, delays []time.Duration, opts *Options) (*APNG, error) {
+  if opts == nil { opts = &Options{} }
+  if len(frames) == 0 { return nil, fmt.Errorf("no frames: %w", imagequant.ErrValueOutOfRange) }
+  if len(delays) != len(frames) {
+    return nil, fmt.Errorf("%d delays for %d frames: %w", len(delays), len(frames), imagequant.ErrValueOutOfRange)
+  }
+
+  size := frames[0].Bounds().Size()
+  canvases := make([]*image.NRGBA, len(frames))
+  for i, frame := range frames {
+    if frame == nil { return nil, fmt.Errorf("frame %d: %w", i, imagequant.ErrInvalidPointer) }
+    if frame.Bounds().Size() != size {
+      return nil, fmt.Errorf("frame %d: size %v differs from %v: %w", i, frame.Bounds().Size(), size, imagequant.ErrValueOutOfRange)
+    }
+    canvases[i] = canvas.New(frame)
+  }
+
+  var att *imagequant.Attributes
+  var err error
+  if opts.Attributes != nil {
+    att, err = opts.Attributes.NewCopy()
+  } else {
+    att, err = imagequant.NewAttributes()
+  }
+  if err != nil { return nil, err }
+  defer att.Close()
+
+  a := &APNG{ Width: size.X, Height: size.Y, LoopCount: opts.LoopCount }
+  plans := planFrames(canvases, delays)
+  if err = a.encodeFrames(att, canvases, plans, opts); err != nil { return nil, err }
+  return a, nil
+}
+
+
+// Used internally. Determines the region, dispose and blend operations of each frame.
+func planFrames(canvases []*image.NRGBA, delays []time.Duration) []framePlan {
+  plans := make([]framePlan, 0, len(canvases))
+  // intended content of the canvas before the current frame is rendered
+  before := image.NewNRGBA(canvases[0].Bounds())
+  for i, cur := range canvases {
+    rect, blend := canvas.DiffRect(before, cur, canvas.Differs), BlendSource
+    if i == 0 {
+      // the first frame covers the whole canvas
+      rect = cur.Bounds()
+    } else if rect.Empty() && plans[len(plans)-1].dispose == DisposeNone {
+      // identical to the previous frame
+      plans[len(plans)-1].delay += delays[i]
+      continue
+    } else if rect.Empty() {
+      // the canvas already shows the frame after disposing the previous frame, but frames must not be empty
+      rect = image.Rect(0, 0, 1, 1)
+    } else if changesOpaque(before, cur, rect) {
+      blend = BlendOver
+    }
+
+    // choosing the operation that requires the smallest region for the next frame
+    dispose := DisposeNone
+    var cleared *image.NRGBA
+    if i + 1 < len(canvases) {
+      next := canvases[i+1]
+      cleared = canvas.Clone(cur)
+      draw.Draw(cleared, rect, image.Transparent, image.Point{}, draw.Src)
+      best := canvas.Area(canvas.DiffRect(cur, next, canvas.Differs))
+      if n := canvas.Area(canvas.DiffRect(cleared, next, canvas.Differs)); n < best {
+        dispose, best = DisposeBackground, n
+      }
+      // the first frame is treated as DisposeBackground
+      if n := canvas.Area(canvas.DiffRect(before, next, canvas.Differs)); i > 0 && n < best {
+        dispose = DisposePrevious
+      }
+    }
+    plans = append(plans, framePlan{ i, rect, dispose, blend, delays[i] })
+
+    switch dispose {
+    case DisposeNone:
+      before = cur
+    case DisposeBackground:
+      before = cleared
+    }
+  }
+  return plans
+}
+
+// Used internally. Quantizes and remaps the frames according to plans.
+func (a *APNG) encodeFrames(att *imagequant.Attributes, canvases []*image.NRGBA, plans []framePlan, opts *Options) error {
+  qimgs := make([]*imagequant.Image, len(plans))
+  defer func() {
+    for _, qimg := range qimgs { qimg.Close() }
+  }()
+  for i, plan := range plans {
+    qimg, err := att.NewImage(canvases[plan.index].SubImage(plan.rect), 0.0)
+    if err != nil { return fmt.Errorf("frame %d: %w", plan.index, err) }
+    qimgs[i] = qimg
+    if plan.blend == BlendOver {
+      if err = att.AddImageFixedColor(qimg, transparent); err != nil { return fmt.Errorf("frame %d: %w", plan.index, err) }
+    }
+  }
+
+  var shared *imagequant.Result
+  if opts.Palette == PaletteShared {
+    hist, err := att.NewHistogram()
+    if err != nil { return err }
+    defer hist.Close()
+    for i, qimg := range qimgs {
+      if err = att.AddImageToHistogram(hist, qimg); err != nil { return fmt.Errorf("frame %d: %w", plans[i].index, err) }
+    }
+    if shared, err = att.QuantizeHistogram(hist); err != nil { return err }
+    defer shared.Close()
+    if err = att.SetDitheringLevel(shared, opts.DitheringLevel); err != nil { return err }
+    a.Palette = att.GetPalette(shared)
+  }
+
+  maxColors := att.GetMaxColors()
+  // actual content of the canvas before the current frame is rendered
+  shown := image.NewNRGBA(canvases[0].Bounds())
+  a.Frames = make([]Frame, len(plans))
+  for i, plan := range plans {
+    qimg := qimgs[i]
+    if plan.blend == BlendOver {
+      bg, err := att.NewImage(shown.SubImage(plan.rect), 0.0)
+      if err != nil { return fmt.Errorf("frame %d: %w", plan.index, err) }
+      err = att.SetImageBackground(qimg, bg)
+      // background is kept alive by qimg
+      bg.Close()
+      if err != nil { return fmt.Errorf("frame %d: %w", plan.index, err) }
+    }
+
+    var pimg *image.Paletted
+    var err error
+    if shared != nil {
+      pimg, err = remap(att, shared, qimg)
+      if err == nil { palette.Convert(pimg, a.Palette) }
+    } else {
+      // distributing the remaining palette entries among the remaining frames
+      colors := (maxColors - len(a.Palette)) / (len(plans) - i)
+      if colors < 2 { colors = 2 }
+      if err = att.SetMaxColors(colors); err == nil {
+        pimg, err = quantizeFrame(att, qimg, opts.DitheringLevel)
+      }
+      if err == nil { a.Palette = mergePalette(pimg, a.Palette) }
+    }
+    if err != nil { return fmt.Errorf("frame %d: %w", plan.index, err) }
+
+    f := &a.Frames[i]
+    f.Image, f.Dispose, f.Blend = pimg, plan.dispose, plan.blend
+    f.SetDelay(plan.delay)
+
+    var prev *image.NRGBA
+    if plan.dispose == DisposePrevious { prev = canvas.Clone(shown) }
+    op := draw.Src
+    if plan.blend == BlendOver { op = draw.Over }
+    draw.Draw(shown, plan.rect, pimg, plan.rect.Min, op)
+    switch plan.dispose {
+    case DisposeBackground:
+      draw.Draw(shown, plan.rect, image.Transparent, image.Point{}, draw.Src)
+    case DisposePrevious:
+      shown = prev
+    }
+  }
+
+  if len(a.Palette) > 256 {
+    return fmt.Errorf("%d colors in palette: %w", len(a.Palette), imagequant.ErrValueOutOfRange)
+  }
+  // all frames refer to the final palette
+  for i := range a.Frames { a.Frames[i].Image.Palette = a.Palette }
+  return nil
+}
+
+// Used internally. Remaps a frame with the given Result object.
+func remap(att *imagequant.Attributes, res *imagequant.Result, qimg *imagequant.Image) (*image.Paletted, error) {
+  img, err := att.WriteRemappedImage(res, qimg)
+  if err != nil { return nil, err }
+  return img.(*image.Paletted), nil
+}
+
+// Used internally. Quantizes and remaps a frame with its own palette.
+func quantizeFrame(att *imagequant.Attributes, qimg *imagequant.Image, ditherLevel float32) (*image.Paletted, error) {
+  res, err := att.QuantizeImage(qimg)
+  if err != nil { return nil, err }
+  defer res.Close()
+  if err = att.SetDitheringLevel(res, ditherLevel); err != nil { return nil, err }
+  return remap(att, res, qimg)
+}
+
+// Used internally. Adds the colors of img missing in p to p and translates the palette indices of img accordingly.
+// Returns the updated palette.
+func mergePalette(img *image.Paletted, p color.Palette) color.Palette {
+  lut := make([]byte, len(img.Palette))
+  for i, c := range img.Palette {
+    j := 0
+    for j < len(p) && !palette.Equal(c, p[j]) { j++ }
+    if j == len(p) { p = append(p, c) }
+    lut[i] = byte(j)
+  }
+  for i := range img.Pix { img.Pix[i] = lut[img.Pix[i]] }
+  img.Palette = p
+  return p
+}
+
+
+// Used internally. Returns whether all pixels in rect that differ in before and cur are fully opaque in cur,
+// so that the frame can be blended over the canvas.
+func changesOpaque(before, cur *image.NRGBA, rect image.Rectangle) bool {
+  for y := rect.Min.Y; y < rect.Max.Y; y++ {
+    for x := rect.Min.X; x < rect.Max.X; x++ {
+      if before.NRGBAAt(x, y) != cur.NRGBAAt(x, y) && cur.NRGBAAt(x, y).A != 0xff { return false }
+    }
+  }
+  return true
+}
@@ -0,0 +1,198 @@
+package apng
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "image"
+  "image/color"
+  "image/png"
+  "io"
+  "testing"
+  "time"
+
+  "github.com/InfinityTools/go-imagequant"
+  "github.com/InfinityTools/go-imagequant/internal/pngchunk"
+)
+
+
+// Used internally. Returns an animation of two frames with a palette of three colors.
+func testAnimation() *APNG {
+  p := color.Palette{ color.NRGBA{ 0, 0, 0, 0 }, color.NRGBA{ 255, 0, 0, 255 }, color.NRGBA{ 0, 0, 255, 128 } }
+  first := image.NewPaletted(image.Rect(0, 0, 8, 6), p)
+  for i := range first.Pix { first.Pix[i] = byte(i % 3) }
+  second := image.NewPaletted(image.Rect(2, 1, 6, 4), p)
+  for i := range second.Pix { second.Pix[i] = 1 }
+  return &APNG{
+    Width: 8, Height: 6, Palette: p, LoopCount: 3,
+    Frames: []Frame{
+      { Image: first, DelayNum: 1, DelayDen: 10 },
+      { Image: second, DelayNum: 20, DelayDen: 100, Dispose: DisposeBackground, Blend: BlendOver },
+    },
+  }
+}
+
+// Used internally. Encodes a and passes the data of each chunk to modify before it is written.
+func encodeModified(t *testing.T, a *APNG, modify func(chunkType string, data []byte) []byte) []byte {
+  t.Helper()
+  var buf bytes.Buffer
+  if err := EncodeAll(&buf, a); err != nil { t.Fatal(err) }
+  r := bytes.NewReader(buf.Bytes())
+  if err := pngchunk.ReadSignature(r); err != nil { t.Fatal(err) }
+  var out bytes.Buffer
+  pngchunk.WriteSignature(&out)
+  for r.Len() > 0 {
+    chunkType, data, err := pngchunk.ReadChunk(r)
+    if err != nil { t.Fatal(err) }
+    pngchunk.WriteChunk(&out, chunkType, modify(chunkType, data))
+  }
+  return out.Bytes()
+}
+
+
+func TestDecodeInvalid(t *testing.T) {
+  tests := []struct {
+    name    string
+    modify  func(chunkType string, data []byte) []byte
+    want    error
+  }{
+    { "negative width", func(chunkType string, data []byte) []byte {
+      if chunkType == "IHDR" { binary.BigEndian.PutUint32(data[0:], 0x80000000) }
+      return data
+    }, ErrFormat },
+    { "zero height", func(chunkType string, data []byte) []byte {
+      if chunkType == "IHDR" { binary.BigEndian.PutUint32(data[4:], 0) }
+      return data
+    }, ErrFormat },
+    { "frame beyond canvas", func(chunkType string, data []byte) []byte {
+      if chunkType == "fcTL" && binary.BigEndian.Uint32(data[12:]) == 2 { binary.BigEndian.PutUint32(data[12:], 5) }
+      return data
+    }, ErrFormat },
+    { "frame offset overflow", func(chunkType string, data []byte) []byte {
+      if chunkType == "fcTL" && binary.BigEndian.Uint32(data[12:]) == 2 { binary.BigEndian.PutUint32(data[12:], 0x7ffffffe) }
+      return data
+    }, ErrFormat },
+    { "invalid dispose operation", func(chunkType string, data []byte) []byte {
+      if chunkType == "fcTL" { data[24] = 3 }
+      return data
+    }, ErrFormat },
+    { "palette index out of range", func(chunkType string, data []byte) []byte {
+      switch chunkType {
+      case "PLTE":
+        return data[:6]
+      case "tRNS":
+        return data[:1]
+      }
+      return data
+    }, ErrFormat },
+    // the image data is far too short for the image size
+    { "huge image", func(chunkType string, data []byte) []byte {
+      if chunkType == "IHDR" || (chunkType == "fcTL" && binary.BigEndian.Uint32(data[0:]) == 0) {
+        ofs := 0
+        if chunkType == "fcTL" { ofs = 4 }
+        binary.BigEndian.PutUint32(data[ofs:], 1 << 20)
+        binary.BigEndian.PutUint32(data[ofs+4:], 1 << 20)
+      }
+      return data
+    }, io.ErrUnexpectedEOF },
+    { "interlaced", func(chunkType string, data []byte) []byte {
+      if chunkType == "IHDR" { data[12] = 1 }
+      return data
+    }, imagequant.ErrUnsupported },
+  }
+  for _, tt := range tests {
+    data := encodeModified(t, testAnimation(), tt.modify)
+    a, err := DecodeAll(bytes.NewReader(data))
+    if !errors.Is(err, tt.want) { t.Errorf("%s: got %v, want %v", tt.name, err, tt.want) }
+    if a != nil { t.Errorf("%s: got animation", tt.name) }
+  }
+}
+
+// Used internally. Returns five frames with a moving square, a frame without the square and translucent pixels.
+func testFrames() []image.Image {
+  frames := make([]image.Image, 5)
+  for i := range frames {
+    f := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+    for j := 0; j < len(f.Pix); j += 4 { copy(f.Pix[j:], []byte{ 0, 0, 255, 255 }) }
+    if i != 3 {
+      for y := 10; y < 14; y++ {
+        for x := i * 4; x < i * 4 + 4; x++ { f.SetNRGBA(x, y, color.NRGBA{ 255, 0, 0, 255 }) }
+      }
+    }
+    if i == 4 {
+      f.SetNRGBA(1, 1, color.NRGBA{ 0, 0, 0, 0 })
+      f.SetNRGBA(2, 2, color.NRGBA{ 0, 255, 0, 128 })
+    }
+    frames[i] = f
+  }
+  return frames
+}
+
+
+func TestRoundTrip(t *testing.T) {
+  frames := testFrames()
+  // the last frame is repeated and merged into the previous one
+  frames = append(frames, frames[4])
+  delays := []time.Duration{ 100, 100, 100, 100, 100, 50 }
+  for i := range delays { delays[i] *= time.Millisecond }
+
+  for _, mode := range []PaletteMode{ PaletteShared, PalettePerFrame } {
+    a, err := Build(frames, delays, &Options{ Palette: mode, LoopCount: 2 })
+    if err != nil { t.Fatalf("mode %d: %v", mode, err) }
+    var buf bytes.Buffer
+    if err = EncodeAll(&buf, a); err != nil { t.Fatalf("mode %d: %v", mode, err) }
+    // the default image must be readable by decoders without APNG support
+    if _, err = png.Decode(bytes.NewReader(buf.Bytes())); err != nil { t.Fatalf("mode %d: image/png: %v", mode, err) }
+    b, err := DecodeAll(&buf)
+    if err != nil { t.Fatalf("mode %d: %v", mode, err) }
+
+    if b.Width != 32 || b.Height != 32 || b.LoopCount != 2 || len(b.Frames) != 5 {
+      t.Fatalf("mode %d: got %dx%d, %d loops, %d frames", mode, b.Width, b.Height, b.LoopCount, len(b.Frames))
+    }
+    if d := b.Frames[4].Delay(); d != 150 * time.Millisecond { t.Errorf("mode %d: got delay %v of merged frame", mode, d) }
+    if len(b.Palette) != len(a.Palette) { t.Errorf("mode %d: got %d colors, want %d", mode, len(b.Palette), len(a.Palette)) }
+    for i := range b.Frames {
+      fa, fb := a.Frames[i], b.Frames[i]
+      if fb.Image.Rect != fa.Image.Rect || fb.Dispose != fa.Dispose || fb.Blend != fa.Blend {
+        t.Errorf("mode %d, frame %d: got %v %d %d, want %v %d %d", mode, i, fb.Image.Rect, fb.Dispose, fb.Blend,
+                 fa.Image.Rect, fa.Dispose, fa.Blend)
+      }
+    }
+
+    // decoded frames must render exactly like the encoded ones, and close to the source frames
+    ra, rb := a.Render(), b.Render()
+    for i := range rb {
+      if !bytes.Equal(ra[i].Pix, rb[i].Pix) { t.Errorf("mode %d: frame %d renders differently after decoding", mode, i) }
+      want := frames[i].(*image.NRGBA)
+      for j := range want.Pix {
+        if d := int(want.Pix[j]) - int(rb[i].Pix[j]); (d < -2 || d > 2) && want.Pix[j - j % 4 + 3] != 0 {
+          t.Errorf("mode %d, frame %d: pixel %d differs from source", mode, i, j / 4)
+          break
+        }
+      }
+    }
+  }
+}
+
+func TestDisposedFrame(t *testing.T) {
+  // the sprite of the first frame is cleared, so that the canvas shows the second frame before it is rendered
+  frames := make([]image.Image, 3)
+  for i := range frames {
+    f := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+    if i == 0 {
+      for y := 2; y < 6; y++ {
+        for x := 2; x < 6; x++ { f.SetNRGBA(x, y, color.NRGBA{ 255, 0, 0, 255 }) }
+      }
+    }
+    frames[i] = f
+  }
+  delays := []time.Duration{ time.Second, time.Second, time.Second }
+  a, err := Build(frames, delays, nil)
+  if err != nil { t.Fatal(err) }
+  // the last frame is identical to the second one
+  if len(a.Frames) != 2 || a.Frames[0].Dispose != DisposeBackground { t.Fatalf("got %d frames, dispose %d", len(a.Frames), a.Frames[0].Dispose) }
+  if d := a.Frames[1].Delay(); d != 2 * time.Second { t.Errorf("got delay %v of second frame", d) }
+  for i, r := range a.Render() {
+    if !bytes.Equal(r.Pix, frames[i].(*image.NRGBA).Pix) { t.Errorf("frame %d renders differently from source", i) }
+  }
+}
@@ -0,0 +1,134 @@
+package apng
+// Reading APNG files.
+
+import (
+  "bufio"
+  "encoding/binary"
+  "fmt"
+  "image"
+  "image/color"
+  "io"
+
+  "github.com/InfinityTools/go-imagequant"
+  "github.com/InfinityTools/go-imagequant/internal/pngchunk"
+)
+
+
+var (
+  // Returned if the data is not a valid PNG image.
+  ErrFormat   = pngchunk.ErrFormat
+  // Returned if a chunk is damaged.
+  ErrChecksum = pngchunk.ErrChecksum
+)
+
+
+// Reads an animated PNG image from r.
+//
+// Only paletted images with 8 bits per pixel and without interlacing are supported. Other images return an error
+// wrapping imagequant.ErrUnsupported. A PNG image without animation is returned as animation with a single frame.
+// The default image is skipped if it is not part of the animation.
+//
+// Returns an error wrapping ErrFormat if a frame exceeds the canvas or refers to a missing palette entry, so that the
+// frames of the returned animation can always be rendered.
+func DecodeAll(r io.Reader) (*APNG, error) {
+  br := bufio.NewReader(r)
+  if err := pngchunk.ReadSignature(br); err != nil { return nil, err }
+
+  a := new(APNG)
+  animated := false
+  // frame currently being read
+  var frame *Frame
+  var data []byte
+  finishFrame := func() error {
+    if frame == nil { return nil }
+    if len(a.Palette) == 0 { return fmt.Errorf("frame %d: missing palette: %w", len(a.Frames), ErrFormat) }
+    pix, err := pngchunk.Decompress(data, frame.Image.Rect.Dx(), frame.Image.Rect.Dy(), 1)
+    if err != nil { return fmt.Errorf("frame %d: %w", len(a.Frames), err) }
+    for _, v := range pix {
+      if int(v) >= len(a.Palette) { return fmt.Errorf("frame %d: palette index %d: %w", len(a.Frames), v, ErrFormat) }
+    }
+    frame.Image.Pix, frame.Image.Palette = pix, a.Palette
+    a.Frames = append(a.Frames, *frame)
+    frame, data = nil, nil
+    return nil
+  }
+
+  for {
+    chunkType, chunk, err := pngchunk.ReadChunk(br)
+    if err != nil {
+      if err == io.EOF { err = io.ErrUnexpectedEOF }
+      return nil, err
+    }
+    // IHDR must be the first chunk
+    if (chunkType == "IHDR") != (a.Width == 0) { return nil, fmt.Errorf("chunk %s out of order: %w", chunkType, ErrFormat) }
+    switch chunkType {
+    case "IHDR":
+      if len(chunk) != 13 || chunk[10] != 0 || chunk[11] != 0 { return nil, ErrFormat }
+      w, h := int32(binary.BigEndian.Uint32(chunk[0:])), int32(binary.BigEndian.Uint32(chunk[4:]))
+      if err = checkSize(w, h); err != nil { return nil, err }
+      a.Width, a.Height = int(w), int(h)
+      if chunk[8] != 8 || chunk[9] != 3 || chunk[12] != 0 {
+        return nil, fmt.Errorf("bit depth %d, color type %d, interlace method %d: %w", chunk[8], chunk[9], chunk[12], imagequant.ErrUnsupported)
+      }
+    case "PLTE":
+      if len(chunk) == 0 || len(chunk) % 3 != 0 || len(chunk) > 3 * 256 || a.Palette != nil { return nil, ErrFormat }
+      a.Palette = make(color.Palette, len(chunk) / 3)
+      for i := range a.Palette {
+        a.Palette[i] = color.NRGBA{ chunk[3*i], chunk[3*i+1], chunk[3*i+2], 0xff }
+      }
+    case "tRNS":
+      if len(chunk) > len(a.Palette) { return nil, ErrFormat }
+      for i, alpha := range chunk {
+        c := a.Palette[i].(color.NRGBA)
+        c.A = alpha
+        a.Palette[i] = c
+      }
+    case "acTL":
+      if len(chunk) != 8 { return nil, ErrFormat }
+      animated = true
+      a.LoopCount = int(binary.BigEndian.Uint32(chunk[4:]))
+    case "fcTL":
+      if len(chunk) != 26 { return nil, ErrFormat }
+      if err = finishFrame(); err != nil { return nil, err }
+      w, h := int32(binary.BigEndian.Uint32(chunk[4:])), int32(binary.BigEndian.Uint32(chunk[8:]))
+      x, y := int32(binary.BigEndian.Uint32(chunk[12:])), int32(binary.BigEndian.Uint32(chunk[16:]))
+      if err = checkSize(w, h); err != nil { return nil, fmt.Errorf("frame %d: %w", len(a.Frames), err) }
+      // frame must fit the canvas, computed in 64 bits to prevent overflows
+      if x < 0 || y < 0 || int64(x) + int64(w) > int64(a.Width) || int64(y) + int64(h) > int64(a.Height) {
+        return nil, fmt.Errorf("frame %d: region %dx%d at (%d, %d) exceeds canvas: %w", len(a.Frames), w, h, x, y, ErrFormat)
+      }
+      if chunk[24] > byte(DisposePrevious) || chunk[25] > byte(BlendOver) { return nil, ErrFormat }
+      frame = &Frame{
+        Image:    &image.Paletted{ Stride: int(w), Rect: image.Rect(int(x), int(y), int(x + w), int(y + h)) },
+        DelayNum: binary.BigEndian.Uint16(chunk[20:]),
+        DelayDen: binary.BigEndian.Uint16(chunk[22:]),
+        Dispose:  DisposeOp(chunk[24]),
+        Blend:    BlendOp(chunk[25]),
+      }
+    case "IDAT":
+      if !animated && frame == nil && len(a.Frames) == 0 {
+        frame = &Frame{ Image: &image.Paletted{ Stride: a.Width, Rect: image.Rect(0, 0, a.Width, a.Height) } }
+      }
+      // default image is not part of the animation if no frame control chunk precedes it
+      if frame != nil { data = append(data, chunk...) }
+    case "fdAT":
+      if len(chunk) < 4 || frame == nil { return nil, ErrFormat }
+      data = append(data, chunk[4:]...)
+    case "IEND":
+      if err = finishFrame(); err != nil { return nil, err }
+      if len(a.Frames) == 0 || len(a.Palette) == 0 { return nil, ErrFormat }
+      return a, nil
+    }
+  }
+}
+
+// Used internally. Checks image dimensions in the same way as the image/png package.
+func checkSize(w, h int32) error {
+  if w <= 0 || h <= 0 { return fmt.Errorf("image size %dx%d: %w", w, h, ErrFormat) }
+  pixels64 := int64(w) * int64(h)
+  pixels := int(pixels64)
+  if int64(pixels) != pixels64 || pixels != pixels * 8 / 8 {
+    return fmt.Errorf("image size %dx%d: %w", w, h, imagequant.ErrUnsupported)
+  }
+  return nil
+}
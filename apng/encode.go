@@ -0,0 +1,103 @@
+package apng
+// Writing APNG files.
+
+import (
+  "bufio"
+  "compress/zlib"
+  "encoding/binary"
+  "fmt"
+  "image"
+  "io"
+  "time"
+
+  "github.com/InfinityTools/go-imagequant"
+  "github.com/InfinityTools/go-imagequant/internal/pngchunk"
+)
+
+
+// Writes the animation a to w in APNG format.
+//
+// The palette must contain 1 to 256 colors. The first frame must cover the whole canvas, all other frames must be
+// located within the canvas. Frames are expected to refer to the palette of the animation.
+func EncodeAll(w io.Writer, a *APNG) error {
+  if err := a.validate(); err != nil { return err }
+
+  bw := bufio.NewWriter(w)
+  if err := pngchunk.WriteSignature(bw); err != nil { return err }
+
+  ihdr := make([]byte, 13)
+  binary.BigEndian.PutUint32(ihdr[0:], uint32(a.Width))
+  binary.BigEndian.PutUint32(ihdr[4:], uint32(a.Height))
+  ihdr[8], ihdr[9] = 8, 3 // bit depth, paletted color type
+  if err := pngchunk.WriteChunk(bw, "IHDR", ihdr); err != nil { return err }
+
+  actl := make([]byte, 8)
+  binary.BigEndian.PutUint32(actl[0:], uint32(len(a.Frames)))
+  binary.BigEndian.PutUint32(actl[4:], uint32(a.LoopCount))
+  if err := pngchunk.WriteChunk(bw, "acTL", actl); err != nil { return err }
+
+  plte, trns := pngchunk.EncodePalette(a.Palette)
+  if err := pngchunk.WriteChunk(bw, "PLTE", plte); err != nil { return err }
+  if len(trns) > 0 {
+    if err := pngchunk.WriteChunk(bw, "tRNS", trns); err != nil { return err }
+  }
+
+  seq := uint32(0)
+  for i := range a.Frames {
+    f := &a.Frames[i]
+    r := f.Image.Bounds()
+    fctl := make([]byte, 26)
+    binary.BigEndian.PutUint32(fctl[0:], seq)
+    binary.BigEndian.PutUint32(fctl[4:], uint32(r.Dx()))
+    binary.BigEndian.PutUint32(fctl[8:], uint32(r.Dy()))
+    binary.BigEndian.PutUint32(fctl[12:], uint32(r.Min.X))
+    binary.BigEndian.PutUint32(fctl[16:], uint32(r.Min.Y))
+    binary.BigEndian.PutUint16(fctl[20:], f.DelayNum)
+    binary.BigEndian.PutUint16(fctl[22:], f.DelayDen)
+    fctl[24], fctl[25] = byte(f.Dispose), byte(f.Blend)
+    if err := pngchunk.WriteChunk(bw, "fcTL", fctl); err != nil { return err }
+    seq++
+
+    data, err := pngchunk.Compress(f.Image.Pix[f.Image.PixOffset(r.Min.X, r.Min.Y):], r.Dx(), f.Image.Stride, r.Dy(), zlib.BestCompression)
+    if err != nil { return err }
+    if i == 0 {
+      err = pngchunk.WriteChunk(bw, "IDAT", data)
+    } else {
+      fdat := make([]byte, 4 + len(data))
+      binary.BigEndian.PutUint32(fdat, seq)
+      copy(fdat[4:], data)
+      err = pngchunk.WriteChunk(bw, "fdAT", fdat)
+      seq++
+    }
+    if err != nil { return err }
+  }
+
+  if err := pngchunk.WriteChunk(bw, "IEND", nil); err != nil { return err }
+  return bw.Flush()
+}
+
+// Same as Build, but writes the animation to w in APNG format.
+func Encode(w io.Writer, frames []image.Image, delays []time.Duration, opts *Options) error {
+  a, err := Build(frames, delays, opts)
+  if err != nil { return err }
+  return EncodeAll(w, a)
+}
+
+
+// Used internally. Checks whether the animation can be encoded.
+func (a *APNG) validate() error {
+  if a.Width <= 0 || a.Height <= 0 { return fmt.Errorf("canvas size %dx%d: %w", a.Width, a.Height, imagequant.ErrValueOutOfRange) }
+  if len(a.Palette) == 0 || len(a.Palette) > 256 {
+    return fmt.Errorf("%d colors in palette: %w", len(a.Palette), imagequant.ErrValueOutOfRange)
+  }
+  if len(a.Frames) == 0 { return fmt.Errorf("no frames: %w", imagequant.ErrValueOutOfRange) }
+  canvas := image.Rect(0, 0, a.Width, a.Height)
+  for i, f := range a.Frames {
+    if f.Image == nil { return fmt.Errorf("frame %d: %w", i, imagequant.ErrInvalidPointer) }
+    r := f.Image.Bounds()
+    if r.Empty() || !r.In(canvas) || (i == 0 && r != canvas) {
+      return fmt.Errorf("frame %d: region %v not valid for canvas %v: %w", i, r, canvas, imagequant.ErrValueOutOfRange)
+    }
+  }
+  return nil
+}
@@ -1,12 +1,46 @@
 package imagequant
 
 /*
+#include <stdint.h>
 #include "libimagequant.h"
+
+extern int goProgressCallback(float, void*);
+extern void goLogCallback(void*, char*, void*);
+extern void goLogFlushCallback(void*, void*);
+
+static void setAttrProgressCallback(liq_attr *attr, uintptr_t handle) {
+  if (handle != 0) {
+    liq_attr_set_progress_callback(attr, goProgressCallback, (void*)handle);
+  } else {
+    liq_attr_set_progress_callback(attr, NULL, NULL);
+  }
+}
+
+static void setAttrLogCallback(liq_attr *attr, uintptr_t handle) {
+  if (handle != 0) {
+    liq_set_log_callback(attr, (liq_log_callback_function*)goLogCallback, (void*)handle);
+  } else {
+    liq_set_log_callback(attr, NULL, NULL);
+  }
+}
+
+static void setAttrLogFlushCallback(liq_attr *attr, uintptr_t handle) {
+  if (handle != 0) {
+    liq_set_log_flush_callback(attr, (liq_log_flush_callback_function*)goLogFlushCallback, (void*)handle);
+  } else {
+    liq_set_log_flush_callback(attr, NULL, NULL);
+  }
+}
 */
 import "C"
 
 import (
+  "errors"
+  "fmt"
+  "log/slog"
   "runtime"
+  "strings"
+  "sync/atomic"
 )
 
 const (
@@ -22,36 +56,117 @@ const (
 )
 
 // The Attributes struct is used to call the majority of quantization functions.
-// This is the only structure that can be released manually.
 type Attributes struct {
-  attr      *C.struct_liq_attr
+  attr            *C.struct_liq_attr
+  lock            guard
+  id              uint64
+  account         memoryAccount
+  progress        ProgressCallback
+  progressHandle  uintptr
+  logger          *slog.Logger
+  log             LogCallback
+  logHandle       uintptr
+  logFlush        LogFlushCallback
+  logFlushHandle  uintptr
+  lastIndexTransparent bool // not available from the library
 }
 
+// Settings contains the quantization settings of an Attributes object. See the respective setter functions for details.
+type Settings struct {
+  MaxColors             int   // See SetMaxColors.
+  Speed                 int   // See SetSpeed.
+  MinQuality            int   // Minimum quality. See SetQuality.
+  MaxQuality            int   // Maximum quality. See SetQuality.
+  MinPosterization      int   // See SetMinPosterization.
+  MinOpacity            int   // See SetMinOpacity.
+  LastIndexTransparent  bool  // See SetLastIndexTransparent.
+}
+
+// Used internally. Source of unique Attributes identifiers.
+var lastAttributesID atomic.Uint64
+
 
 // Returns an object that will hold initial settings (attributes) for the library. 
 //
+// Objects created with the help of the Attributes object (Image, Histogram and Result) remain valid after the 
+// Attributes object has been released. Returns nil if the object could not be created, see NewAttributes.
+//
 // IMPORTANT: The object must be freed by Release after it is no longer needed.
 func CreateAttributes() *Attributes {
+  att, _ := NewAttributes()
+  return att
+}
+
+// Same as CreateAttributes, but returns an error if the object could not be created.
+func NewAttributes() (*Attributes, error) {
+  account, ok := newMemoryAccount(0)
+  if !ok { return nil, getError("liq_attr_create", C.LIQ_OUT_OF_MEMORY) }
   att := new(Attributes)
-  att.attr = C.liq_attr_create()
+  att.attr = account.createAttr()
+  if att.attr == nil {
+    account.release()
+    return nil, getError("liq_attr_create", C.LIQ_OUT_OF_MEMORY)
+  }
+  att.account = account
+  att.id = lastAttributesID.Add(1)
+  liveAttributes.Add(1)
+  att.lock.open = true
   runtime.SetFinalizer(att, freeAttribute)
-  return att
+  return att, nil
 }
 
-// Creates an independent copy of the calling object.
+// Creates an independent copy of the calling object. Returns nil if the calling object has been closed.
 //
 // IMPORTANT: The copy must also be freed by the Release function.
 func (att *Attributes) CopyAttribute() *Attributes {
+  att2, _ := att.NewCopy()
+  return att2
+}
+
+// Same as CopyAttribute, but returns an error if the copy could not be created.
+func (att *Attributes) NewCopy() (*Attributes, error) {
+  if !att.acquire() { return nil, invalidPointer("liq_attr_copy") }
+  defer att.release()
+  account, ok := newMemoryAccount(att.account.limit())
+  if !ok { return nil, getError("liq_attr_copy", C.LIQ_OUT_OF_MEMORY) }
   att2 := new(Attributes)
-  att2.attr = C.liq_attr_copy(att.attr)
+  account.run(func() { att2.attr = C.liq_attr_copy(att.attr) })
+  if att2.attr == nil {
+    account.release()
+    return nil, getError("liq_attr_copy", C.LIQ_OUT_OF_MEMORY)
+  }
+  att2.account = account
+  att2.id = lastAttributesID.Add(1)
+  liveAttributes.Add(1)
+  att2.lastIndexTransparent = att.lastIndexTransparent
+  att2.lock.open = true
   runtime.SetFinalizer(att2, freeAttribute)
-  return att2
+  // callback handles of the original object must not be shared
+  att2.SetProgressCallback(att.progress)
+  if att.logger != nil {
+    att2.SetLogger(att.logger)
+  } else {
+    att2.SetLogCallback(att.log)
+  }
+  att2.SetLogFlushCallback(att.logFlush)
+  return att2, nil
 }
 
 // Call this function to manually release the attributes.
-// Otherwise, Golang's own garbage collector will take care of it eventually.
+// Otherwise, Golang's own garbage collector will take care of it eventually. Same as Close.
 func (att *Attributes) Release() {
-  freeAttribute(att)
+  att.Close()
+}
+
+// Close releases the attributes. It implements the io.Closer interface and always returns nil.
+//
+// Calling Close more than once has no effect. Close waits for functions using the object in other goroutines to complete.
+// Functions called with a closed object return ErrInvalidPointer, or -1 if they only return a numeric value.
+func (att *Attributes) Close() error {
+  if att == nil { return nil }
+  att.lock.close(func() { freeAttribute(att) })
+  runtime.SetFinalizer(att, nil)
+  return nil
 }
 
 
@@ -60,12 +175,16 @@ func (att *Attributes) Release() {
 // Instead of setting a fixed limit it's better to use SetQuality.
 // Returns ErrValueOutOfRange if number of colors is outside the range 2-256.
 func (att *Attributes) SetMaxColors(colors int) error {
+  if !att.acquireExclusive() { return invalidPointer("liq_set_max_colors") }
+  defer att.releaseExclusive()
   code := C.liq_set_max_colors(att.attr, C.int(colors))
-  return getError(code)
+  return getError("liq_set_max_colors", code)
 }
 
 // Returns the value set by SetMaxColors.
 func (att *Attributes) GetMaxColors() int {
+  if !att.acquire() { return -1 }
+  defer att.release()
   retVal := C.liq_get_max_colors(att.attr)
   return int(retVal)
 }
@@ -82,12 +201,16 @@ func (att *Attributes) GetMaxColors() int {
 //    Additional quantization techniques  1-6
 // Returns ErrValueOutOfRange if the speed is outside the 1-10 range.
 func (att *Attributes) SetSpeed(speed int) error {
+  if !att.acquireExclusive() { return invalidPointer("liq_set_speed") }
+  defer att.releaseExclusive()
   code := C.liq_set_speed(att.attr, C.int(speed))
-  return getError(code)
+  return getError("liq_set_speed", code)
 }
 
 // Returns the value set by SetSpeed.
 func (att *Attributes) GetSpeed() int {
+  if !att.acquire() { return -1 }
+  defer att.release()
   retVal := C.liq_get_speed(att.attr)
   return int(retVal)
 }
@@ -99,12 +222,16 @@ func (att *Attributes) GetSpeed() int {
 //
 // Returns LIQ_VALUE_OUT_OF_RANGE if the value is outside the 0-4 range.
 func (att *Attributes) SetMinPosterization(bits int) error {
+  if !att.acquireExclusive() { return invalidPointer("liq_set_min_posterization") }
+  defer att.releaseExclusive()
   code := C.liq_set_min_posterization(att.attr, C.int(bits))
-  return getError(code)
+  return getError("liq_set_min_posterization", code)
 }
 
 // Returns the value set by SetMinPosterization.
 func (att *Attributes) GetMinPosterization() int {
+  if !att.acquire() { return -1 }
+  defer att.release()
   retVal := C.liq_get_min_posterization(att.attr)
   return int(retVal)
 }
@@ -123,12 +250,16 @@ func (att *Attributes) GetMinPosterization() int {
 // Returns ErrValueOutOfRange if target is lower than minimum or any of them is outside the 0-100 range. 
 // Returns ErrInvalidPointer if attr appears to be invalid.
 func (att *Attributes) SetQuality(min, max int) error {
+  if !att.acquireExclusive() { return invalidPointer("liq_set_quality") }
+  defer att.releaseExclusive()
   code := C.liq_set_quality(att.attr, C.int(min), C.int(max))
-  return getError(code)
+  return getError("liq_set_quality", code)
 }
 
 // Returns the minimum/maximum range of quality set by SetQuality.
 func (att *Attributes) GetQuality() (min, max int) {
+  if !att.acquire() { return -1, -1 }
+  defer att.release()
   min = int(C.liq_get_min_quality(att.attr))
   max = int(C.liq_get_max_quality(att.attr))
   return
@@ -137,11 +268,223 @@ func (att *Attributes) GetQuality() (min, max int) {
 // Setting to false makes alpha colors sorted before opaque colors. "true" mixes colors together except completely transparent color, 
 // which is moved to the end of the palette. This is a workaround for programs that blindly assume the last palette entry is transparent.
 func (att *Attributes) SetLastIndexTransparent(set bool) {
+  if !att.acquireExclusive() { return }
+  defer att.releaseExclusive()
   v := 0
   if set { v = 1 }
   C.liq_set_last_index_transparent(att.attr, C.int(v))
+  att.lastIndexTransparent = set
+}
+
+// Returns the value set by SetLastIndexTransparent.
+func (att *Attributes) GetLastIndexTransparent() bool {
+  if !att.acquire() { return false }
+  defer att.release()
+  return att.lastIndexTransparent
+}
+
+// Specifies the alpha level at which colors are considered fully opaque. The default is 255.
+//
+// Colors with alpha values at or above this level are rounded up to be fully opaque.
+// Depending on the library version this setting may have no effect.
+// Returns ErrValueOutOfRange if the value is outside the 0-255 range.
+func (att *Attributes) SetMinOpacity(min int) error {
+  if !att.acquireExclusive() { return invalidPointer("liq_set_min_opacity") }
+  defer att.releaseExclusive()
+  code := C.liq_set_min_opacity(att.attr, C.int(min))
+  return getError("liq_set_min_opacity", code)
+}
+
+// Returns the value set by SetMinOpacity.
+func (att *Attributes) GetMinOpacity() int {
+  if !att.acquire() { return -1 }
+  defer att.release()
+  retVal := C.liq_get_min_opacity(att.attr)
+  return int(retVal)
+}
+
+// Limits the memory the library may allocate on behalf of this object to the given number of bytes. 0 removes the limit,
+// which is the default.
+//
+// The limit covers all memory allocated while this object is used to create, quantize or remap Image, Histogram and
+// Result objects. Allocations exceeding the limit fail, in which case the respective functions return ErrOutOfMemory.
+// Copies of the object inherit the limit, but are accounted separately. Only allocations of the calling thread are
+// covered, allocations of OpenMP worker threads of the library are neither charged nor limited.
+// Returns ErrValueOutOfRange if the limit is negative.
+func (att *Attributes) SetMemoryLimit(limit int64) error {
+  if !att.acquireExclusive() { return invalidPointer("SetMemoryLimit") }
+  defer att.releaseExclusive()
+  if limit < 0 { return newError("SetMemoryLimit", ErrValueOutOfRange, "limit %d", limit) }
+  att.account.setLimit(limit)
+  return nil
+}
+
+// Returns the value set by SetMemoryLimit.
+func (att *Attributes) GetMemoryLimit() int64 {
+  if !att.acquire() { return -1 }
+  defer att.release()
+  return att.account.limit()
+}
+
+// Returns the number of bytes currently allocated by the library on behalf of this object, including memory of 
+// Image, Histogram and Result objects that has been allocated with its help and not been released yet. Allocations of
+// OpenMP worker threads of the library are not included, see SetMemoryLimit.
+func (att *Attributes) GetMemoryUsage() int64 {
+  if !att.acquire() { return -1 }
+  defer att.release()
+  return att.account.usage()
+}
+
+// Returns a snapshot of all quantization settings. Numeric fields are -1 if the object has been closed.
+func (att *Attributes) Settings() Settings {
+  if !att.acquire() {
+    return Settings{ MaxColors: -1, Speed: -1, MinQuality: -1, MaxQuality: -1, MinPosterization: -1, MinOpacity: -1 }
+  }
+  defer att.release()
+  return Settings{
+    MaxColors:            int(C.liq_get_max_colors(att.attr)),
+    Speed:                int(C.liq_get_speed(att.attr)),
+    MinQuality:           int(C.liq_get_min_quality(att.attr)),
+    MaxQuality:           int(C.liq_get_max_quality(att.attr)),
+    MinPosterization:     int(C.liq_get_min_posterization(att.attr)),
+    MinOpacity:           int(C.liq_get_min_opacity(att.attr)),
+    LastIndexTransparent: att.lastIndexTransparent,
+  }
+}
+
+// Applies all quantization settings at once.
+//
+// Settings are validated before any of them is applied. Returns an error that combines the errors of all 
+// invalid settings, each of them wrapping ErrValueOutOfRange. Settings remain unchanged in this case.
+// The object is locked while the settings are applied, so that other goroutines never see a partial update.
+func (att *Attributes) ApplySettings(s Settings) error {
+  if !att.acquireExclusive() { return invalidPointer("ApplySettings") }
+  defer att.releaseExclusive()
+  var errs []error
+  check := func(name string, value, min, max int) {
+    if value < min || value > max {
+      errs = append(errs, fmt.Errorf("%s %d not in range [%d, %d]: %w", name, value, min, max, ErrValueOutOfRange))
+    }
+  }
+  check("MaxColors", s.MaxColors, 2, 256)
+  check("Speed", s.Speed, SPEED_SLOWEST, SPEED_FASTEST)
+  check("MinQuality", s.MinQuality, QUALITY_WORST, s.MaxQuality)
+  check("MaxQuality", s.MaxQuality, QUALITY_WORST, QUALITY_BEST)
+  check("MinPosterization", s.MinPosterization, 0, 4)
+  check("MinOpacity", s.MinOpacity, 0, 255)
+  if len(errs) > 0 { return errors.Join(errs...) }
+
+  // setters of the object can't be used while the lock is held
+  errs = append(errs, getError("liq_set_max_colors", C.liq_set_max_colors(att.attr, C.int(s.MaxColors))))
+  errs = append(errs, getError("liq_set_speed", C.liq_set_speed(att.attr, C.int(s.Speed))))
+  errs = append(errs, getError("liq_set_quality", C.liq_set_quality(att.attr, C.int(s.MinQuality), C.int(s.MaxQuality))))
+  errs = append(errs, getError("liq_set_min_posterization", C.liq_set_min_posterization(att.attr, C.int(s.MinPosterization))))
+  errs = append(errs, getError("liq_set_min_opacity", C.liq_set_min_opacity(att.attr, C.int(s.MinOpacity))))
+  v := 0
+  if s.LastIndexTransparent { v = 1 }
+  C.liq_set_last_index_transparent(att.attr, C.int(v))
+  att.lastIndexTransparent = s.LastIndexTransparent
+  return errors.Join(errs...)
+}
+
+
+// Sets a callback function that is called periodically during quantization (QuantizeImage and QuantizeHistogram).
+//
+// The callback function receives the progress in percent and returns false to abort the operation, in which case 
+// the quantization functions return ErrAborted. Specify nil to remove the callback function.
+func (att *Attributes) SetProgressCallback(cb ProgressCallback) {
+  if !att.acquireExclusive() { return }
+  defer att.releaseExclusive()
+  unregisterCallback(att.progressHandle)
+  att.progress, att.progressHandle = nil, 0
+  if cb != nil {
+    att.progress, att.progressHandle = cb, registerCallback(cb)
+  }
+  C.setAttrProgressCallback(att.attr, C.uintptr_t(att.progressHandle))
+}
+
+// Sets a callback function that receives diagnostic messages from the library, such as palette sizes, 
+// timing and posterization decisions. Specify nil to remove the callback function.
+//
+// Messages may be buffered by the library until the log flush callback is called. See SetLogFlushCallback.
+func (att *Attributes) SetLogCallback(cb LogCallback) {
+  if !att.acquireExclusive() { return }
+  defer att.releaseExclusive()
+  att.setLogCallback(cb)
+  att.logger = nil
 }
 
+// Sets a callback function that is called when the library flushes buffered log messages. Specify nil to remove the callback function.
+func (att *Attributes) SetLogFlushCallback(cb LogFlushCallback) {
+  if !att.acquireExclusive() { return }
+  defer att.releaseExclusive()
+  unregisterCallback(att.logFlushHandle)
+  att.logFlush, att.logFlushHandle = nil, 0
+  if cb != nil {
+    att.logFlush, att.logFlushHandle = cb, registerCallback(cb)
+  }
+  C.setAttrLogFlushCallback(att.attr, C.uintptr_t(att.logFlushHandle))
+}
+
+// Forwards diagnostic messages from the library to the given structured logger. Specify nil to stop logging.
+//
+// Messages are logged at level Info with leading and trailing whitespace removed. The attribute "attributes" identifies 
+// the Attributes object that generated the message and "library" is set to "libimagequant".
+// This function replaces a callback set by SetLogCallback.
+func (att *Attributes) SetLogger(logger *slog.Logger) {
+  if !att.acquireExclusive() { return }
+  defer att.releaseExclusive()
+  if logger == nil {
+    att.setLogCallback(nil)
+    att.logger = nil
+    return
+  }
+  // closure must not refer to att to keep it collectable
+  l := logger.With(slog.String("library", "libimagequant"), slog.Uint64("attributes", att.id))
+  att.setLogCallback(func(message string) {
+    l.Info(strings.TrimSpace(message))
+  })
+  att.logger = logger
+}
+
+
+// Used internally. Registers the log callback function. Exclusive access must be held by the caller.
+func (att *Attributes) setLogCallback(cb LogCallback) {
+  unregisterCallback(att.logHandle)
+  att.log, att.logHandle = nil, 0
+  if cb != nil {
+    att.log, att.logHandle = cb, registerCallback(cb)
+  }
+  C.setAttrLogCallback(att.attr, C.uintptr_t(att.logHandle))
+}
+
+// Used internally. Returns a reference to the memory account of the object, which must be released after use.
+// Returns an empty account if the object is not available, in which case allocations are only counted by Stats.
+func (att *Attributes) retainAccount() memoryAccount {
+  if !att.acquire() { return memoryAccount{} }
+  defer att.release()
+  return att.account.retain()
+}
+
+// Used internally. Acquires shared access to the object. Returns false if the object is not available.
+func (att *Attributes) acquire() bool {
+  return att != nil && att.lock.acquire()
+}
+
+// Used internally. Releases shared access to the object.
+func (att *Attributes) release() {
+  att.lock.release()
+}
+
+// Used internally. Acquires exclusive access to the object. Returns false if the object is not available.
+func (att *Attributes) acquireExclusive() bool {
+  return att != nil && att.lock.acquireExclusive()
+}
+
+// Used internally. Releases exclusive access to the object.
+func (att *Attributes) releaseExclusive() {
+  att.lock.releaseExclusive()
+}
 
 // Used internally. Frees a Attributes object.
 func freeAttribute(att *Attributes) {
@@ -149,6 +492,14 @@ func freeAttribute(att *Attributes) {
     // fmt.Println("Releasing Attributes object.")
     C.liq_attr_destroy(att.attr)
     att.attr = nil
-    runtime.GC()
+    att.account.release()
+    att.account = memoryAccount{}
+    liveAttributes.Add(-1)
+    unregisterCallback(att.progressHandle)
+    unregisterCallback(att.logHandle)
+    unregisterCallback(att.logFlushHandle)
+    att.progress, att.progressHandle = nil, 0
+    att.logger, att.log, att.logHandle = nil, nil, 0
+    att.logFlush, att.logFlushHandle = nil, 0
   }
 }
@@ -0,0 +1,161 @@
+package imagequant
+// Concurrent quantization of multiple images.
+
+import (
+  "context"
+  "image"
+  "runtime"
+)
+
+
+// Batch quantizes and remaps a sequence of images concurrently. Each worker uses its own copy of the Attributes object,
+// so that the settings can be shared safely by all workers.
+type Batch struct {
+  // Attributes defines the quantization settings. Default settings are used if nil.
+  // The object is never modified by Batch.
+  Attributes      *Attributes
+  // Workers defines the number of images processed concurrently. runtime.GOMAXPROCS(0) is used if Workers <= 0.
+  Workers         int
+  // DitheringLevel is used when remapping images. See SetDitheringLevel. A zero value disables dithering; set it to
+  // 1.0 for the library default.
+  DitheringLevel  float32
+}
+
+// BatchResult contains the outcome of quantizing a single image of a Batch.
+type BatchResult struct {
+  Index     int             // Position of the image in the input sequence, starting at 0
+  Image     *image.Paletted // The remapped image, or nil on error
+  Quality   int             // Quantization quality in range 0-100, see GetQuantizationQuality. -1 if not available
+  Err       error           // Error that occurred while processing the image
+}
+
+// Used internally. A single image of a Batch and the channel receiving its result.
+type batchJob struct {
+  index   int
+  img     image.Image
+  done    chan BatchResult
+}
+
+
+// Quantizes all images received from the images channel and returns a channel that receives the results in the order of
+// the input images. The results channel is closed after the images channel has been closed and all images are processed.
+//
+// When ctx is cancelled no more images are received from the images channel. Images that are already being processed
+// are completed with an error wrapping ErrAborted and the error returned by ctx.Err(). Afterwards the results channel is
+// closed and all workers have finished.
+//
+// The caller must receive from the results channel until it is closed.
+func (b *Batch) Run(ctx context.Context, images <-chan image.Image) <-chan BatchResult {
+  workers := b.Workers
+  if workers <= 0 { workers = runtime.GOMAXPROCS(0) }
+
+  jobs := make(chan batchJob)
+  pending := make(chan chan BatchResult, workers)
+  results := make(chan BatchResult)
+
+  // distributing images in input order
+  go func() {
+    defer close(jobs)
+    defer close(pending)
+    for index := 0; ; index++ {
+      var img image.Image
+      var ok bool
+      select {
+      case <-ctx.Done():
+        return
+      case img, ok = <-images:
+        if !ok { return }
+      }
+      job := batchJob{ index, img, make(chan BatchResult, 1) }
+      pending <- job.done
+      jobs <- job
+    }
+  }()
+
+  for i := 0; i < workers; i++ {
+    go b.worker(ctx, jobs)
+  }
+
+  // collecting results in input order
+  go func() {
+    defer close(results)
+    for done := range pending {
+      results <- <-done
+    }
+  }()
+
+  return results
+}
+
+// Same as Run, but takes a slice of images and returns the results after all images have been processed.
+//
+// A result is returned for each image, even if ctx is cancelled prematurely.
+func (b *Batch) RunAll(ctx context.Context, images []image.Image) []BatchResult {
+  in := make(chan image.Image)
+  go func() {
+    defer close(in)
+    for _, img := range images {
+      select {
+      case <-ctx.Done():
+        return
+      case in <- img:
+      }
+    }
+  }()
+
+  results := make([]BatchResult, len(images))
+  processed := make([]bool, len(images))
+  for r := range b.Run(ctx, in) {
+    results[r.Index], processed[r.Index] = r, true
+  }
+  for i := range results {
+    if !processed[i] {
+      results[i] = BatchResult{ Index: i, Quality: -1, Err: contextError(ctx, ErrAborted) }
+    }
+  }
+  return results
+}
+
+
+// Used internally. Processes jobs until the jobs channel is closed.
+func (b *Batch) worker(ctx context.Context, jobs <-chan batchJob) {
+  att, err := b.attributes(ctx)
+  if err == nil { defer att.Release() }
+  for job := range jobs {
+    r := BatchResult{ Index: job.index, Quality: -1, Err: err }
+    if err == nil { b.process(ctx, att, job.img, &r) }
+    job.done <- r
+  }
+}
+
+// Used internally. Returns the attributes of a worker, with a progress callback that observes ctx.
+func (b *Batch) attributes(ctx context.Context) (att *Attributes, err error) {
+  if b.Attributes != nil {
+    att, err = b.Attributes.NewCopy()
+  } else {
+    att, err = NewAttributes()
+  }
+  if err != nil { return }
+  att.SetProgressCallback(contextProgressCallback(ctx, att.progress))
+  return
+}
+
+// Used internally. Quantizes and remaps a single image.
+func (b *Batch) process(ctx context.Context, att *Attributes, img image.Image, r *BatchResult) {
+  if img == nil { r.Err = invalidPointer("Batch.Run"); return }
+  if ctx.Err() != nil { r.Err = contextError(ctx, ErrAborted); return }
+
+  qimg, err := att.NewImage(img, 0.0)
+  if err != nil { r.Err = err; return }
+  defer qimg.Close()
+
+  res, err := att.QuantizeImage(qimg)
+  if err != nil { r.Err = contextError(ctx, err); return }
+  defer res.Close()
+  r.Quality = att.GetQuantizationQuality(res)
+
+  if err = att.SetDitheringLevel(res, b.DitheringLevel); err != nil { r.Err = err; return }
+  imgOut, err := att.WriteRemappedImageContext(ctx, res, qimg)
+  if err != nil { r.Err = err; return }
+  r.Image = imgOut.(*image.Paletted)
+}
@@ -0,0 +1,109 @@
+package imagequant
+// Support for callback functions invoked by the C library.
+//
+// Go pointers must not be stored in C memory. Callback functions are therefore kept in a registry on the Go side
+// and only the numeric handle of a registry entry is passed to the C library as "user_info" argument.
+
+/*
+#include "libimagequant.h"
+*/
+import "C"
+
+import (
+  "image/color"
+  "sync"
+  "unsafe"
+)
+
+
+// ProgressCallback is called by the library periodically during quantization and remapping.
+//
+// percent indicates the progress of the current operation in range [0, 100].
+// Return true to continue the operation or false to abort it. Aborted operations return ErrAborted.
+// The callback function must not modify or release any of the objects involved in the operation.
+type ProgressCallback func(percent float32) bool
+
+// RowCallback is called by the library to request pixel data of a single image row.
+//
+// y is the row index. dst must be filled with the non-premultiplied colors of the row and must not be retained after the call returns.
+type RowCallback func(y int, dst []color.NRGBA)
+
+// LogCallback is called by the library for each diagnostic message.
+// The callback function must not modify or release the Attributes object that generated the message.
+type LogCallback func(message string)
+
+// LogFlushCallback is called by the library when buffered log messages should be written out.
+type LogFlushCallback func()
+
+
+// Used internally. Maps handles to callback functions.
+var callbackRegistry = struct {
+  sync.Mutex
+  next    uintptr
+  entries map[uintptr]interface{}
+}{ entries: make(map[uintptr]interface{}) }
+
+
+// Used internally. Stores the given callback function and returns a handle that can be passed to the C library.
+func registerCallback(cb interface{}) uintptr {
+  callbackRegistry.Lock()
+  defer callbackRegistry.Unlock()
+  callbackRegistry.next++
+  handle := callbackRegistry.next
+  callbackRegistry.entries[handle] = cb
+  return handle
+}
+
+// Used internally. Returns the callback function associated with the given handle. Returns nil if handle is not registered.
+func lookupCallback(handle uintptr) interface{} {
+  callbackRegistry.Lock()
+  defer callbackRegistry.Unlock()
+  return callbackRegistry.entries[handle]
+}
+
+// Used internally. Removes the callback function associated with the given handle from the registry.
+func unregisterCallback(handle uintptr) {
+  if handle == 0 { return }
+  callbackRegistry.Lock()
+  defer callbackRegistry.Unlock()
+  delete(callbackRegistry.entries, handle)
+}
+
+
+// Used internally. Entry point for liq_attr_set_progress_callback and liq_result_set_progress_callback.
+//
+//export goProgressCallback
+func goProgressCallback(percent C.float, userInfo unsafe.Pointer) C.int {
+  if cb, ok := lookupCallback(uintptr(userInfo)).(ProgressCallback); ok && cb != nil {
+    if !cb(float32(percent)) { return 0 }
+  }
+  return 1
+}
+
+// Used internally. Entry point for liq_image_create_custom.
+//
+//export goImageRowCallback
+func goImageRowCallback(rowOut *C.liq_color, row C.int, width C.int, userInfo unsafe.Pointer) {
+  if cb, ok := lookupCallback(uintptr(userInfo)).(RowCallback); ok && cb != nil {
+    // liq_color and color.NRGBA share the same memory layout
+    cb(int(row), unsafe.Slice((*color.NRGBA)(unsafe.Pointer(rowOut)), int(width)))
+  }
+}
+
+// Used internally. Entry point for liq_set_log_callback.
+//
+//export goLogCallback
+func goLogCallback(attr unsafe.Pointer, message *C.char, userInfo unsafe.Pointer) {
+  if cb, ok := lookupCallback(uintptr(userInfo)).(LogCallback); ok && cb != nil {
+    cb(C.GoString(message))
+  }
+}
+
+// Used internally. Entry point for liq_set_log_flush_callback.
+//
+//export goLogFlushCallback
+func goLogFlushCallback(attr unsafe.Pointer, userInfo unsafe.Pointer) {
+  if cb, ok := lookupCallback(uintptr(userInfo)).(LogFlushCallback); ok && cb != nil {
+    cb()
+  }
+}
@@ -0,0 +1,349 @@
+/*
+Command goquant converts PNG images to paletted PNG images. Options are compatible with the pngquant command line tool.
+
+Usage:
+
+  goquant [options] [ncolors] [--] pngfile [pngfile ...]
+  goquant [options] [ncolors] - < input.png > output.png
+
+ncolors defines the maximum number of colors (2 to 256, default: 256). Output files are written next to the input
+files with the suffix defined by --ext, unless --output is specified. The input file "-" reads from stdin and writes
+to stdout. Options may be specified with one or two leading dashes.
+
+Exit codes match pngquant: 0 on success, 1 if no input file is specified, 2 if an input file cannot be read or is
+not a valid PNG image, 4 for invalid arguments, 15 if an output file exists and --force is not specified, 16 if an
+output file cannot be written, 17 if the library runs out of memory, 98 if a file is skipped because of
+--skip-if-larger and 99 if the quality is below the minimum quality defined by --quality. Other failures of the
+imagequant library return the library error code, e.g. 100 for invalid values. If multiple files fail, the exit code
+of the last failure is returned.
+*/
+package main
+
+import (
+  "bytes"
+  "errors"
+  "flag"
+  "fmt"
+  "image"
+  "image/png"
+  "io"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+
+  "github.com/InfinityTools/go-imagequant"
+  qpng "github.com/InfinityTools/go-imagequant/png"
+)
+
+
+// Exit codes as used by pngquant
+const (
+  exitSuccess         = 0
+  exitMissingArgument = 1
+  exitReadError       = 2
+  exitInvalidArgument = 4
+  exitNotOverwriting  = 15
+  exitWriteError      = 16
+  exitOutOfMemory     = 17
+  exitTooLargeFile    = 98
+  exitTooLowQuality   = 99
+  exitLibraryError    = 100 // first library error code, used for library errors without code
+)
+
+// options contains the command line settings.
+type options struct {
+  colors        int
+  quality       qualityFlag
+  speed         int
+  dither        ditherFlag
+  nofs          bool
+  posterize     int
+  ext           string
+  output        string
+  force         bool
+  skipIfLarger  bool
+  strip         bool
+}
+
+// qualityFlag parses the pngquant quality formats "min-max", "max", "-max" and "min-".
+type qualityFlag struct {
+  min, max  int
+  set       bool
+}
+
+func (q *qualityFlag) String() string {
+  if q == nil || !q.set { return "" }
+  return fmt.Sprintf("%d-%d", q.min, q.max)
+}
+
+func (q *qualityFlag) Set(s string) error {
+  var err1, err2 error
+  minStr, maxStr, ranged := strings.Cut(s, "-")
+  switch {
+  case !ranged:
+    q.max, err1 = strconv.Atoi(s)
+    q.min = q.max * 9 / 10
+  case minStr == "":
+    q.min = 0
+    q.max, err1 = strconv.Atoi(maxStr)
+  case maxStr == "":
+    q.min, err1 = strconv.Atoi(minStr)
+    q.max = 100
+  default:
+    q.min, err1 = strconv.Atoi(minStr)
+    q.max, err2 = strconv.Atoi(maxStr)
+  }
+  if err1 != nil || err2 != nil || q.min < 0 || q.max > 100 || q.min > q.max {
+    return errors.New("quality must be specified as min-max in range 0 to 100")
+  }
+  q.set = true
+  return nil
+}
+
+// ditherFlag is a dithering level that can be specified as boolean flag or with an explicit level.
+type ditherFlag float32
+
+func (d *ditherFlag) String() string {
+  if d == nil { return "" }
+  return strconv.FormatFloat(float64(*d), 'g', -1, 32)
+}
+
+func (d *ditherFlag) Set(s string) error {
+  switch s {
+  case "true":
+    *d = 1
+    return nil
+  case "false":
+    *d = 0
+    return nil
+  }
+  v, err := strconv.ParseFloat(s, 32)
+  if err != nil || v < 0 || v > 1 { return errors.New("dithering level must be in range 0 to 1") }
+  *d = ditherFlag(v)
+  return nil
+}
+
+func (d *ditherFlag) IsBoolFlag() bool { return true }
+
+
+func main() {
+  os.Exit(run(os.Args[1:]))
+}
+
+// Parses the command line arguments, processes all files and returns the exit code.
+func run(args []string) int {
+  o := options{ speed: 4, dither: 1 }
+  fs := flag.NewFlagSet("goquant", flag.ContinueOnError)
+  showVersion := fs.Bool("version", false, "Print library version and exit")
+  fs.BoolVar(&o.force, "force", false, "Overwrite existing output files")
+  fs.BoolVar(&o.force, "f", false, "Same as --force")
+  fs.BoolVar(&o.skipIfLarger, "skip-if-larger", false, "Only save converted files if they are smaller than the original files")
+  fs.StringVar(&o.output, "output", "", "Destination file path for a single input file, \"-\" writes to stdout")
+  fs.StringVar(&o.output, "o", "", "Same as --output")
+  fs.StringVar(&o.ext, "ext", "", "Suffix for output file names (default: \"-or8.png\" without dithering, \"-fs8.png\" otherwise)")
+  fs.Var(&o.quality, "quality", "`min-max`: don't save below min, use fewer colors below max (0-100)")
+  fs.Var(&o.quality, "Q", "Same as --quality")
+  fs.IntVar(&o.speed, "speed", o.speed, "Speed/quality trade-off from 1 (slowest) to 10 (fastest)")
+  fs.IntVar(&o.speed, "s", o.speed, "Same as --speed")
+  fs.BoolVar(&o.nofs, "nofs", false, "Disable Floyd-Steinberg dithering")
+  fs.Var(&o.dither, "floyd", "Floyd-Steinberg dithering level from 0 to 1, e.g. --floyd=0.5 (default: 1)")
+  fs.IntVar(&o.posterize, "posterize", 0, "Output lower-precision color, `bits` from 0 to 4")
+  fs.BoolVar(&o.strip, "strip", false, "Accepted for compatibility, has no effect since metadata of input files is never copied")
+  fs.Usage = func() {
+    fmt.Fprintf(fs.Output(), "Usage: %s [options] [ncolors] [--] pngfile [pngfile ...]\n", fs.Name())
+    fmt.Fprintf(fs.Output(), "       %s [options] [ncolors] - < input.png > output.png\nOptions:\n", fs.Name())
+    fs.PrintDefaults()
+  }
+
+  // options may follow positional arguments as in pngquant
+  var files []string
+  for {
+    if err := fs.Parse(args); err != nil {
+      if err == flag.ErrHelp { return exitSuccess }
+      return exitInvalidArgument
+    }
+    rest := fs.Args()
+    if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+      files = append(files, rest...)
+      break
+    }
+    if len(rest) == 0 { break }
+    files = append(files, rest[0])
+    args = rest[1:]
+  }
+
+  if *showVersion {
+    fmt.Printf("libimagequant '%s'\n", imagequant.GetVersionString())
+    return exitSuccess
+  }
+
+  if len(files) > 1 {
+    if n, err := strconv.Atoi(files[0]); err == nil {
+      o.colors = n
+      files = files[1:]
+    }
+  }
+  if len(files) == 0 {
+    fs.Usage()
+    return exitMissingArgument
+  }
+  if o.output != "" && len(files) > 1 {
+    fmt.Fprintln(os.Stderr, "--output can only be used with a single input file")
+    return exitInvalidArgument
+  }
+  if o.nofs { o.dither = 0 }
+  // default suffix depends on the final dithering level, as in pngquant
+  if o.ext == "" {
+    o.ext = "-fs8.png"
+    if o.dither == 0 { o.ext = "-or8.png" }
+  }
+
+  att, err := o.attributes()
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return exitInvalidArgument
+  }
+  defer att.Release()
+
+  retVal := exitSuccess
+  for _, file := range files {
+    if code := o.processFile(att, file); code != exitSuccess { retVal = code }
+  }
+  return retVal
+}
+
+// Returns an Attributes object with the quantization settings.
+func (o *options) attributes() (*imagequant.Attributes, error) {
+  att, err := imagequant.NewAttributes()
+  if err != nil { return nil, err }
+  if err = o.configure(att); err != nil {
+    att.Release()
+    return nil, err
+  }
+  return att, nil
+}
+
+// Applies the quantization settings to att.
+func (o *options) configure(att *imagequant.Attributes) error {
+  if o.colors != 0 {
+    if err := att.SetMaxColors(o.colors); err != nil { return fmt.Errorf("number of colors %d: %w", o.colors, err) }
+  }
+  if err := att.SetSpeed(o.speed); err != nil { return fmt.Errorf("speed %d: %w", o.speed, err) }
+  if o.quality.set {
+    if err := att.SetQuality(o.quality.min, o.quality.max); err != nil { return fmt.Errorf("quality %s: %w", o.quality.String(), err) }
+  }
+  if err := att.SetMinPosterization(o.posterize); err != nil { return fmt.Errorf("posterize %d: %w", o.posterize, err) }
+  return nil
+}
+
+// Converts a single file and returns the exit code.
+func (o *options) processFile(att *imagequant.Attributes, file string) int {
+  outFile := o.outputName(file)
+  if outFile != "-" && !o.force {
+    if _, err := os.Stat(outFile); err == nil {
+      fmt.Fprintf(os.Stderr, "%s: not overwriting %s, use --force\n", file, outFile)
+      return exitNotOverwriting
+    }
+  }
+
+  var data []byte
+  var err error
+  if file == "-" {
+    data, err = io.ReadAll(os.Stdin)
+  } else {
+    data, err = os.ReadFile(file)
+  }
+  var imgIn image.Image
+  if err == nil { imgIn, err = png.Decode(bytes.NewReader(data)) }
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+    return exitReadError
+  }
+  if data, err = o.quantize(att, imgIn, data); err != nil {
+    fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+    return exitCode(err)
+  }
+
+  if err = writeFile(outFile, data); err != nil {
+    fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+    return exitWriteError
+  }
+  return exitSuccess
+}
+
+// Returns the exit code for an error of quantize.
+func exitCode(err error) int {
+  var qerr *imagequant.Error
+  switch {
+  case errors.Is(err, imagequant.ErrQualityTooLow):
+    return exitTooLowQuality
+  case errors.Is(err, imagequant.ErrOutOfMemory):
+    return exitOutOfMemory
+  case errors.Is(err, errTooLarge):
+    return exitTooLargeFile
+  case errors.As(err, &qerr) && qerr.Code >= exitLibraryError:
+    return qerr.Code
+  default:
+    return exitLibraryError
+  }
+}
+
+// Returned by quantize if the converted image is larger than the original and --skip-if-larger is specified.
+var errTooLarge = errors.New("converted image is larger than the original, skipped")
+
+// Returns the converted image in PNG format. original contains the data of the input file.
+func (o *options) quantize(att *imagequant.Attributes, imgIn image.Image, original []byte) ([]byte, error) {
+  qimg, err := att.NewImage(imgIn, 0.0)
+  if err != nil { return nil, err }
+  defer qimg.Close()
+
+  res, err := att.QuantizeImage(qimg)
+  if err != nil { return nil, err }
+  defer res.Close()
+
+  if err = att.SetDitheringLevel(res, float32(o.dither)); err != nil { return nil, err }
+  imgOut, err := att.WriteRemappedImage(res, qimg)
+  if err != nil { return nil, err }
+  // dithering may reduce the quality below the limit
+  if minQuality, _ := att.GetQuality(); minQuality > 0 {
+    if q := att.GetRemappingQuality(res); q >= 0 && q < minQuality {
+      return nil, fmt.Errorf("quality %d below minimum %d: %w", q, minQuality, imagequant.ErrQualityTooLow)
+    }
+  }
+
+  var buf bytes.Buffer
+  encoder := qpng.Encoder{
+    CompressionLevel:     qpng.BestCompression,
+    Gamma:                att.GetOutputGamma(res),
+    OptimizePalette:      true,
+    LastIndexTransparent: att.GetLastIndexTransparent(),
+  }
+  if err = encoder.Encode(&buf, imgOut.(*image.Paletted)); err != nil { return nil, err }
+  if o.skipIfLarger && buf.Len() > len(original) { return nil, errTooLarge }
+  return buf.Bytes(), nil
+}
+
+// Returns the output file name for the given input file name.
+func (o *options) outputName(file string) string {
+  if o.output != "" { return o.output }
+  if file == "-" { return "-" }
+  if ext := filepath.Ext(file); strings.EqualFold(ext, ".png") { file = file[:len(file)-len(ext)] }
+  return file + o.ext
+}
+
+// Writes data to the given file, or stdout if name is "-". Files are replaced atomically, which allows to overwrite
+// the input file.
+func writeFile(name string, data []byte) error {
+  if name == "-" {
+    _, err := os.Stdout.Write(data)
+    return err
+  }
+  f, err := os.CreateTemp(filepath.Dir(name), ".goquant-*.tmp")
+  if err != nil { return err }
+  defer os.Remove(f.Name())
+  if _, err = f.Write(data); err == nil { err = f.Chmod(0644) }
+  if err2 := f.Close(); err == nil { err = err2 }
+  if err != nil { return err }
+  return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "image"
+  "image/color"
+  "image/png"
+  "os"
+  "path/filepath"
+  "testing"
+
+  "github.com/InfinityTools/go-imagequant"
+)
+
+
+// Used internally. Writes a PNG image with a gradient of many colors to the given file.
+func writeTestImage(t *testing.T, name string) {
+  t.Helper()
+  img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+  for y := 0; y < 32; y++ {
+    for x := 0; x < 32; x++ { img.SetNRGBA(x, y, color.NRGBA{ byte(x * 8), byte(y * 8), byte(x * y), 255 }) }
+  }
+  f, err := os.Create(name)
+  if err != nil { t.Fatal(err) }
+  defer f.Close()
+  if err = png.Encode(f, img); err != nil { t.Fatal(err) }
+}
+
+// Used internally. Returns the number of palette colors of a PNG file, or -1 if it is not a paletted image.
+func paletteSize(t *testing.T, name string) int {
+  t.Helper()
+  f, err := os.Open(name)
+  if err != nil { t.Fatal(err) }
+  defer f.Close()
+  img, err := png.Decode(f)
+  if err != nil { t.Fatal(err) }
+  if p, ok := img.(*image.Paletted); ok { return len(p.Palette) }
+  return -1
+}
+
+
+func TestQualityFlag(t *testing.T) {
+  tests := []struct {
+    arg       string
+    min, max  int   // -1 if the argument is invalid
+  }{
+    { "60-80", 60, 80 }, { "80", 72, 80 }, { "-80", 0, 80 }, { "60-", 60, 100 }, { "0-100", 0, 100 }, { "70-70", 70, 70 },
+    { "", -1, -1 }, { "abc", -1, -1 }, { "80-60", -1, -1 }, { "101", -1, -1 }, { "0-101", -1, -1 }, { "1-2-3", -1, -1 },
+  }
+  for _, tt := range tests {
+    var q qualityFlag
+    err := q.Set(tt.arg)
+    if tt.min < 0 {
+      if err == nil { t.Errorf("%q: got %s, want error", tt.arg, q.String()) }
+      continue
+    }
+    if err != nil || q.min != tt.min || q.max != tt.max || q.String() != fmt.Sprintf("%d-%d", tt.min, tt.max) {
+      t.Errorf("%q: got %d-%d, %v, want %d-%d", tt.arg, q.min, q.max, err, tt.min, tt.max)
+    }
+  }
+}
+
+func TestDitherFlag(t *testing.T) {
+  tests := []struct {
+    arg   string
+    want  ditherFlag  // -1 if the argument is invalid
+  }{
+    { "true", 1 }, { "false", 0 }, { "0.5", 0.5 }, { "0", 0 }, { "1", 1 }, { "1.5", -1 }, { "-0.5", -1 }, { "abc", -1 },
+  }
+  for _, tt := range tests {
+    var d ditherFlag
+    err := d.Set(tt.arg)
+    if tt.want < 0 {
+      if err == nil { t.Errorf("%q: got %s, want error", tt.arg, d.String()) }
+    } else if err != nil || d != tt.want {
+      t.Errorf("%q: got %s, %v, want %v", tt.arg, d.String(), err, tt.want)
+    }
+  }
+}
+
+func TestOutputName(t *testing.T) {
+  tests := []struct {
+    o     options
+    file  string
+    want  string
+  }{
+    { options{ ext: "-fs8.png" }, "dir/image.png", "dir/image-fs8.png" },
+    { options{ ext: "-or8.png" }, "image.PNG", "image-or8.png" },
+    { options{ ext: "-fs8.png" }, "image.gif", "image.gif-fs8.png" },
+    { options{ ext: "-fs8.png" }, "image", "image-fs8.png" },
+    { options{ ext: ".png" }, "image.png", "image.png" },
+    { options{ ext: "-fs8.png" }, "-", "-" },
+    { options{ ext: "-fs8.png", output: "out.png" }, "image.png", "out.png" },
+    { options{ ext: "-fs8.png", output: "-" }, "image.png", "-" },
+  }
+  for _, tt := range tests {
+    if got := tt.o.outputName(tt.file); got != tt.want { t.Errorf("%+v, %q: got %q, want %q", tt.o, tt.file, got, tt.want) }
+  }
+}
+
+func TestExitCode(t *testing.T) {
+  tests := []struct {
+    err   error
+    want  int
+  }{
+    { fmt.Errorf("quality: %w", imagequant.ErrQualityTooLow), exitTooLowQuality },
+    { &imagequant.Error{ Op: "liq_image_quantize", Code: 101, Err: imagequant.ErrOutOfMemory }, exitOutOfMemory },
+    { errTooLarge, exitTooLargeFile },
+    { &imagequant.Error{ Op: "liq_image_quantize", Code: 100, Err: imagequant.ErrValueOutOfRange }, 100 },
+    { &imagequant.Error{ Op: "liq_write_remapped_image", Code: 105, Err: imagequant.ErrInvalidPointer }, 105 },
+    { &imagequant.Error{ Op: "liq_image_quantize", Code: 200, Err: imagequant.ErrUnknown }, 200 },
+    { &imagequant.Error{ Op: "RemapToPalette", Code: -1, Err: imagequant.ErrUnknown }, exitLibraryError },
+    { fmt.Errorf("palette index 3: %w", imagequant.ErrValueOutOfRange), exitLibraryError },
+  }
+  for _, tt := range tests {
+    if got := exitCode(tt.err); got != tt.want { t.Errorf("%v: got %d, want %d", tt.err, got, tt.want) }
+  }
+}
+
+func TestRun(t *testing.T) {
+  dir := t.TempDir()
+  wd, err := os.Getwd()
+  if err != nil { t.Fatal(err) }
+  if err = os.Chdir(dir); err != nil { t.Fatal(err) }
+  defer os.Chdir(wd)
+  for _, name := range []string{ "a.png", "b.png", "-c.png" } { writeTestImage(t, name) }
+  if err = os.WriteFile("invalid.png", []byte("no image"), 0644); err != nil { t.Fatal(err) }
+
+  tests := []struct {
+    name    string
+    args    []string
+    want    int
+    output  string  // file that must exist afterwards
+    colors  int     // maximum number of colors of output, 0 if not checked
+  }{
+    { "no arguments", nil, exitMissingArgument, "", 0 },
+    { "help", []string{ "-h" }, exitSuccess, "", 0 },
+    { "unknown option", []string{ "--unknown", "a.png" }, exitInvalidArgument, "", 0 },
+    { "invalid quality", []string{ "--quality", "80-60", "a.png" }, exitInvalidArgument, "", 0 },
+    { "invalid dithering", []string{ "--floyd=2", "a.png" }, exitInvalidArgument, "", 0 },
+    { "invalid speed", []string{ "--speed", "11", "a.png" }, exitInvalidArgument, "", 0 },
+    { "invalid number of colors", []string{ "1", "a.png" }, exitInvalidArgument, "", 0 },
+    { "output with multiple files", []string{ "-o", "out.png", "a.png", "b.png" }, exitInvalidArgument, "", 0 },
+    { "missing file", []string{ "missing.png" }, exitReadError, "", 0 },
+    { "invalid file", []string{ "invalid.png" }, exitReadError, "", 0 },
+    { "default", []string{ "a.png" }, exitSuccess, "a-fs8.png", 256 },
+    { "not overwriting", []string{ "a.png" }, exitNotOverwriting, "", 0 },
+    // options may follow positional arguments
+    { "colors", []string{ "16", "a.png", "--force" }, exitSuccess, "a-fs8.png", 16 },
+    { "nofs", []string{ "--nofs", "8", "a.png", "b.png" }, exitSuccess, "b-or8.png", 8 },
+    { "floyd without level", []string{ "--floyd", "-f", "a.png", "--ext", ".x.png" }, exitSuccess, "a.x.png", 256 },
+    { "floyd zero", []string{ "--floyd=0", "-f", "a.png" }, exitSuccess, "a-or8.png", 0 },
+    { "output", []string{ "-Q", "0-100", "a.png", "-o", "out.png" }, exitSuccess, "out.png", 0 },
+    // arguments after -- are files, even if they start with a dash
+    { "end of options", []string{ "4", "--", "-c.png" }, exitSuccess, "-c-fs8.png", 4 },
+    { "end of options after file", []string{ "--ext", "-y.png", "b.png", "--", "-c.png" }, exitSuccess, "-c-y.png", 0 },
+    { "too low quality", []string{ "--quality", "100-100", "--ext", "-q.png", "2", "a.png" }, exitTooLowQuality, "", 0 },
+    // the last failure determines the exit code
+    { "multiple failures", []string{ "-f", "invalid.png", "missing.png", "a.png" }, exitReadError, "", 0 },
+  }
+  for _, tt := range tests {
+    if got := run(tt.args); got != tt.want { t.Errorf("%s: got exit code %d, want %d", tt.name, got, tt.want) }
+    if tt.output == "" { continue }
+    if _, err = os.Stat(tt.output); err != nil { t.Errorf("%s: %v", tt.name, err); continue }
+    if n := paletteSize(t, tt.output); n < 0 || (tt.colors > 0 && n > tt.colors) { t.Errorf("%s: got %d colors, want at most %d", tt.name, n, tt.colors) }
+  }
+  if _, err = os.Stat("a-q.png"); !errors.Is(err, os.ErrNotExist) { t.Errorf("got output file of too low quality: %v", err) }
+  if _, err = os.Stat(filepath.Join(dir, "invalid-fs8.png")); !errors.Is(err, os.ErrNotExist) { t.Errorf("got output file of invalid input: %v", err) }
+}
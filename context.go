@@ -0,0 +1,74 @@
+package imagequant
+// Quantization and remapping functions that can be interrupted by a context.
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "image"
+)
+
+
+// Same as QuantizeImage, but aborts quantization when ctx is cancelled or its deadline expires.
+//
+// The returned error wraps both ErrAborted and the error returned by ctx.Err() if the operation was interrupted.
+func (att *Attributes) QuantizeImageContext(ctx context.Context, img *Image) (res *Result, err error) {
+  if err = ctx.Err(); err != nil { return nil, contextError(ctx, ErrAborted) }
+  att2 := att.copyWithContext(ctx)
+  defer att2.Release()
+  res, err = att2.QuantizeImage(img)
+  err = contextError(ctx, err)
+  return
+}
+
+// Same as QuantizeHistogram, but aborts quantization when ctx is cancelled or its deadline expires.
+//
+// The returned error wraps both ErrAborted and the error returned by ctx.Err() if the operation was interrupted.
+func (att *Attributes) QuantizeHistogramContext(ctx context.Context, hist *Histogram) (res *Result, err error) {
+  if err = ctx.Err(); err != nil { return nil, contextError(ctx, ErrAborted) }
+  att2 := att.copyWithContext(ctx)
+  defer att2.Release()
+  res, err = att2.QuantizeHistogram(hist)
+  err = contextError(ctx, err)
+  return
+}
+
+// Same as WriteRemappedImage, but aborts remapping when ctx is cancelled or its deadline expires.
+//
+// A progress callback set by SetResultProgressCallback is still called during the operation.
+// The returned error wraps both ErrAborted and the error returned by ctx.Err() if the operation was interrupted.
+func (att *Attributes) WriteRemappedImageContext(ctx context.Context, res *Result, img *Image) (imgOut image.Image, err error) {
+  if err = ctx.Err(); err != nil { return nil, contextError(ctx, ErrAborted) }
+  imgOut, err = att.writeRemappedImage(res, img, func(cb ProgressCallback) ProgressCallback {
+    return contextProgressCallback(ctx, cb)
+  })
+  err = contextError(ctx, err)
+  return
+}
+
+
+// Used internally. Returns a copy of the attributes with a progress callback that observes ctx, or nil if att has been
+// closed.
+func (att *Attributes) copyWithContext(ctx context.Context) *Attributes {
+  att2 := att.CopyAttribute()
+  // the copy is not shared yet, and its callback was taken over while att was locked
+  if att2 != nil { att2.SetProgressCallback(contextProgressCallback(ctx, att2.progress)) }
+  return att2
+}
+
+// Used internally. Returns a progress callback that aborts if ctx is done. Calls to the optional callback cb are chained.
+func contextProgressCallback(ctx context.Context, cb ProgressCallback) ProgressCallback {
+  return func(percent float32) bool {
+    if ctx.Err() != nil { return false }
+    if cb != nil { return cb(percent) }
+    return true
+  }
+}
+
+// Used internally. Adds the context error to ErrAborted if the operation was interrupted by ctx.
+func contextError(ctx context.Context, err error) error {
+  if errors.Is(err, ErrAborted) && ctx.Err() != nil {
+    return fmt.Errorf("%w: %w", err, ctx.Err())
+  }
+  return err
+}
@@ -0,0 +1,128 @@
+package imagequant
+// Adapters for the quantization and drawing interfaces of Go's image/draw package.
+
+import (
+  "image"
+  "image/color"
+  "image/draw"
+
+  "github.com/InfinityTools/go-imagequant/internal/palette"
+)
+
+
+// DrawQuantizer implements the draw.Quantizer and draw.Drawer interfaces. It can be used wherever the standard library
+// accepts these interfaces, e.g. as Quantizer and Drawer of gif.Options.
+type DrawQuantizer struct {
+  // Attributes defines the quantization settings. Default settings are used if nil.
+  // The object is never modified by DrawQuantizer.
+  Attributes      *Attributes
+  // DitheringLevel is used by Draw when remapping images. See SetDitheringLevel. Unlike the library default of 1.0,
+  // the zero value disables dithering.
+  DitheringLevel  float32
+}
+
+
+// Quantize implements the draw.Quantizer interface.
+//
+// Colors already present in p are reserved as fixed colors and retain their indices. The palette is filled up with
+// colors generated by the library until cap(p) colors are available, but never more than 256 colors.
+// The draw.Quantizer interface cannot report errors, so p is returned unchanged if quantization fails, e.g. if m is
+// empty or if the library runs out of memory.
+func (q *DrawQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+  capacity := cap(p)
+  if capacity > 256 { capacity = 256 }
+  free := capacity - len(p)
+  if free <= 0 { return p }
+
+  att := q.attributes()
+  defer att.Release()
+  maxColors := capacity
+  if maxColors < 2 { maxColors = 2 }
+  if err := att.SetMaxColors(maxColors); err != nil { return p }
+
+  qimg := att.CreateImage(m, 0.0)
+  if qimg == nil { return p }
+  for _, c := range p {
+    if err := att.AddImageFixedColor(qimg, c); err != nil { return p }
+  }
+
+  res, err := att.QuantizeImage(qimg)
+  if err != nil { return p }
+  defer res.Close()
+
+  return mergeFixedColors(p, att.GetPalette(res), free)
+}
+
+// Used internally. Appends up to free colors of the generated palette pal to p, skipping the fixed colors of p that
+// the library included in pal. Exact matches take precedence. Otherwise a color that differs by at most 1 in each
+// component is skipped, since the library may round fixed colors.
+func mergeFixedColors(p, pal color.Palette, free int) color.Palette {
+  fixed := make([]bool, len(pal))
+  matched := make([]bool, len(p))
+  for j, c := range p {
+    for i := range pal {
+      if !fixed[i] && palette.Equal(pal[i], c) {
+        fixed[i], matched[j] = true, true
+        break
+      }
+    }
+  }
+  for j, c := range p {
+    if matched[j] { continue }
+    for i := range pal {
+      if !fixed[i] && containsNear(color.Palette{ c }, pal[i]) {
+        fixed[i] = true
+        break
+      }
+    }
+  }
+
+  retVal := p
+  for i, c := range pal {
+    if !fixed[i] && len(retVal) - len(p) < free { retVal = append(retVal, c) }
+  }
+  return retVal
+}
+
+// Draw implements the draw.Drawer interface.
+//
+// If dst is a *image.Paletted, the source pixels are remapped to the palette of dst by the library with the dithering
+// level defined by DitheringLevel. Otherwise, or if remapping fails, the request is forwarded to draw.FloydSteinberg.
+func (q *DrawQuantizer) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+  pdst, ok := dst.(*image.Paletted)
+  if !ok || len(pdst.Palette) == 0 || len(pdst.Palette) > 256 {
+    draw.FloydSteinberg.Draw(dst, r, src, sp)
+    return
+  }
+
+  // clipping rules of draw.Draw
+  orig := r.Min
+  r = r.Intersect(dst.Bounds())
+  r = r.Intersect(src.Bounds().Add(orig.Sub(sp)))
+  if r.Empty() { return }
+  sp = sp.Add(r.Min.Sub(orig))
+
+  region := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+  draw.Draw(region, region.Bounds(), src, sp, draw.Src)
+
+  att := q.attributes()
+  defer att.Release()
+  remapped, err := att.RemapToPalette(region, pdst.Palette, q.DitheringLevel)
+  if err != nil {
+    draw.FloydSteinberg.Draw(dst, r, src, sp)
+    return
+  }
+
+  width := r.Dx()
+  for y := 0; y < r.Dy(); y++ {
+    dofs := pdst.PixOffset(r.Min.X, r.Min.Y + y)
+    copy(pdst.Pix[dofs:dofs+width], remapped.Pix[y*remapped.Stride:y*remapped.Stride+width])
+  }
+}
+
+
+// Used internally. Returns an independent Attributes object that must be released after use.
+func (q *DrawQuantizer) attributes() *Attributes {
+  if q.Attributes != nil { return q.Attributes.CopyAttribute() }
+  return CreateAttributes()
+}
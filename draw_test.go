@@ -0,0 +1,59 @@
+package imagequant
+
+import (
+  "image"
+  "image/color"
+  "testing"
+
+  "github.com/InfinityTools/go-imagequant/internal/palette"
+)
+
+
+func TestMergeFixedColors(t *testing.T) {
+  red, green, blue := color.NRGBA{ 255, 0, 0, 255 }, color.NRGBA{ 0, 255, 0, 255 }, color.NRGBA{ 0, 0, 255, 255 }
+  gray, white := color.NRGBA{ 128, 128, 128, 255 }, color.NRGBA{ 255, 255, 255, 255 }
+  tests := []struct {
+    name  string
+    p     color.Palette // fixed colors
+    pal   color.Palette // palette generated by the library
+    free  int
+    want  color.Palette
+  }{
+    { "exact", color.Palette{ red, green }, color.Palette{ blue, green, red, gray }, 2, color.Palette{ red, green, blue, gray } },
+    // the rounded copy of green must not take the place of a generated color
+    { "rounded", color.Palette{ red, green }, color.Palette{ color.NRGBA{ 1, 254, 0, 255 }, red, blue, gray }, 2,
+      color.Palette{ red, green, blue, gray } },
+    // the exact match of red takes precedence over the rounded copy
+    { "exact before rounded", color.Palette{ red }, color.Palette{ color.NRGBA{ 254, 0, 0, 255 }, red, blue }, 2,
+      color.Palette{ red, color.NRGBA{ 254, 0, 0, 255 }, blue } },
+    { "limited", color.Palette{ red }, color.Palette{ red, blue, gray, white }, 2, color.Palette{ red, blue, gray } },
+    { "no fixed colors", nil, color.Palette{ blue, gray }, 4, color.Palette{ blue, gray } },
+  }
+  for _, tt := range tests {
+    got := mergeFixedColors(tt.p, tt.pal, tt.free)
+    if len(got) != len(tt.want) { t.Errorf("%s: got %v, want %v", tt.name, got, tt.want); continue }
+    for i := range got {
+      if !palette.Equal(got[i], tt.want[i]) { t.Errorf("%s: got %v, want %v", tt.name, got, tt.want); break }
+    }
+  }
+}
+
+func TestDrawQuantizer(t *testing.T) {
+  fixed := color.Palette{ color.NRGBA{ 0, 0, 0, 0 }, color.NRGBA{ 255, 255, 255, 255 } }
+  p := make(color.Palette, len(fixed), 16)
+  copy(p, fixed)
+  got := (&DrawQuantizer{}).Quantize(p, gradientImage(16, 16))
+  if len(got) != 16 { t.Fatalf("got %d colors, want 16", len(got)) }
+  for i, c := range fixed {
+    if got[i] != c { t.Errorf("got color %v at %d, want %v", got[i], i, c) }
+  }
+  for i := range got {
+    for j := i + 1; j < len(got); j++ {
+      if palette.Equal(got[i], got[j]) { t.Errorf("color %v at %d and %d", got[i], i, j) }
+    }
+  }
+
+  // failed quantization returns the palette unchanged
+  empty := image.NewNRGBA(image.Rect(0, 0, 0, 0))
+  if got := (&DrawQuantizer{}).Quantize(p, empty); len(got) != len(p) { t.Errorf("got %d colors after failure", len(got)) }
+}
@@ -3,10 +3,12 @@ package main
 import (
   "flag"
   "fmt"
+  "image"
   "image/png"
   "os"
 
   "github.com/InfinityTools/go-imagequant"
+  qpng "github.com/InfinityTools/go-imagequant/png"
 )
 
 func main() {
@@ -28,18 +30,18 @@ func main() {
     os.Exit(0)
   }
 
-  var cLevel png.CompressionLevel
+  var cLevel qpng.CompressionLevel
   switch *Compression {
     case 0:
-      cLevel = png.DefaultCompression
+      cLevel = qpng.DefaultCompression
     case -1:
-      cLevel = png.NoCompression
+      cLevel = qpng.NoCompression
     case -2:
-      cLevel = png.BestSpeed
+      cLevel = qpng.BestSpeed
     case -3:
-      cLevel = png.BestCompression
+      cLevel = qpng.BestCompression
     default:
-      cLevel = png.BestCompression
+      cLevel = qpng.BestCompression
   }
 
   err := quantizeFile(*InFile, *OutFile, *Speed, cLevel)
@@ -51,7 +53,7 @@ func main() {
   os.Exit(0)
 }
 
-func quantizeFile(inFile, outFile string, speed int, compression png.CompressionLevel) error {
+func quantizeFile(inFile, outFile string, speed int, compression qpng.CompressionLevel) error {
   fin, err := os.OpenFile(inFile, os.O_RDONLY, 0444)
   if err != nil {
     return fmt.Errorf("os.OpenFile: %s", err.Error())
@@ -71,9 +73,9 @@ func quantizeFile(inFile, outFile string, speed int, compression png.Compression
   defer quant.Release()
 
   // Add the source image to the quantizer. Second argument "gamma" is left to the default 0.
-  qimg := quant.CreateImage(imgIn, 0.0)
-  if qimg == nil {
-    return fmt.Errorf("quant.CreateImage: Could not initialize image structure")
+  qimg, err := quant.NewImage(imgIn, 0.0)
+  if err != nil {
+    return fmt.Errorf("quant.NewImage: %s", err.Error())
   }
 
   // Generate the palette.
@@ -94,8 +96,9 @@ func quantizeFile(inFile, outFile string, speed int, compression png.Compression
   }
   defer fout.Close()
 
-  encoder := png.Encoder{CompressionLevel: compression, BufferPool: nil}
-  err = encoder.Encode(fout, imgOut)
+  // The paletted PNG encoder stores the palette and gamma as compact as possible.
+  encoder := qpng.Encoder{CompressionLevel: compression, Gamma: quant.GetOutputGamma(qresult)}
+  err = encoder.Encode(fout, imgOut.(*image.Paletted))
   if err != nil {
     return fmt.Errorf("png.Encode: %s", err.Error())
   }
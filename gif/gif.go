@@ -0,0 +1,301 @@
+/*
+Package gif creates animated GIF images with the help of the imagequant library.
+
+Frames are cropped to the region that changed since the previous frame and remapped with the previous frame as
+background (see imagequant's SetImageBackground), so that unchanged pixels become transparent and compress well.
+*/
+package gif
+
+import (
+  "fmt"
+  "image"
+  "image/color"
+  "image/draw"
+  "image/gif"
+  "io"
+
+  "github.com/InfinityTools/go-imagequant"
+  "github.com/InfinityTools/go-imagequant/internal/canvas"
+  "github.com/InfinityTools/go-imagequant/internal/palette"
+)
+
+
+// PaletteMode defines whether frames use a global palette or local palettes.
+type PaletteMode int
+
+const (
+  // PaletteAuto uses a global palette, but generates a local palette for each frame that cannot be represented by the
+  // global palette with sufficient quality. See Options.MinQuality.
+  PaletteAuto PaletteMode = iota
+  // PaletteGlobal uses a single palette for all frames.
+  PaletteGlobal
+  // PaletteLocal generates a separate palette for each frame.
+  PaletteLocal
+)
+
+// Options defines optional parameters of Build.
+type Options struct {
+  // Attributes defines the quantization settings. Default settings are used if nil.
+  // The object is never modified by Build.
+  Attributes      *imagequant.Attributes
+  // DitheringLevel is used when remapping frames. See SetDitheringLevel. The zero value disables dithering, while the
+  // library default is 1.0.
+  DitheringLevel  float32
+  // Palette defines whether frames use a global palette or local palettes.
+  Palette         PaletteMode
+  // MinQuality defines the remapping quality a frame must achieve with the global palette in mode PaletteAuto.
+  // imagequant.QUALITY_GOOD is used if MinQuality is 0.
+  MinQuality      int
+  // LoopCount is passed to the LoopCount field of the gif.GIF structure.
+  LoopCount       int
+}
+
+// Used internally. Encoding parameters of a single frame, determined by comparing the source frames.
+type framePlan struct {
+  index     int             // index of the source frame
+  rect      image.Rectangle // region of the canvas covered by the frame
+  disposal  byte            // disposal method
+  delay     int             // delay in 100ths of a second
+}
+
+// Used internally. The fully transparent color reserved in all palettes.
+var transparent = imagequant.Color{ R: 0, G: 0, B: 0, A: 0 }
+
+
+// Creates an animation from the given frames. delays defines the display duration of each frame in 100ths of a second.
+//
+// All frames must have the same size. GIF images do not support translucency: pixels with alpha values below 128 become
+// fully transparent, all other pixels become fully opaque. Consecutive identical frames are merged into a single frame.
+// Default options are used if opts is nil.
+//
+// Returns an error wrapping imagequant.ErrValueOutOfRange if frames is empty, the number of delays does not match the
+// number of frames or the frames differ in size.
+func Build(frames []image.Image, delays []int, opts *Options) (*gif.GIF, error) {
+  if opts == nil { opts = &Options{} }
+  if len(frames) == 0 { return nil, fmt.Errorf("no frames: %w", imagequant.ErrValueOutOfRange) }
+  if len(delays) != len(frames) {
+    return nil, fmt.Errorf("%d delays for %d frames: %w", len(delays), len(frames), imagequant.ErrValueOutOfRange)
+  }
+
+  size := frames[0].Bounds().Size()
+  canvases := make([]*image.NRGBA, len(frames))
+  for i, frame := range frames {
+    if frame == nil { return nil, fmt.Errorf("frame %d: %w", i, imagequant.ErrInvalidPointer) }
+    if frame.Bounds().Size() != size {
+      return nil, fmt.Errorf("frame %d: size %v differs from %v: %w", i, frame.Bounds().Size(), size, imagequant.ErrValueOutOfRange)
+    }
+    canvases[i] = toCanvas(frame)
+  }
+
+  att, err := attributes(opts.Attributes)
+  if err != nil { return nil, err }
+  defer att.Close()
+
+  plans := planFrames(canvases, delays)
+  return encodeFrames(att, canvases, plans, opts)
+}
+
+// Same as Build, but writes the animation to w.
+func Encode(w io.Writer, frames []image.Image, delays []int, opts *Options) error {
+  g, err := Build(frames, delays, opts)
+  if err != nil { return err }
+  return gif.EncodeAll(w, g)
+}
+
+
+// Used internally. Returns an independent Attributes object that must be released after use.
+func attributes(att *imagequant.Attributes) (*imagequant.Attributes, error) {
+  if att != nil { return att.NewCopy() }
+  return imagequant.NewAttributes()
+}
+
+// Used internally. Determines the region and disposal method of each frame.
+func planFrames(canvases []*image.NRGBA, delays []int) []framePlan {
+  plans := make([]framePlan, 0, len(canvases))
+  // intended content of the canvas before the current frame is drawn
+  before := image.NewNRGBA(canvases[0].Bounds())
+  for i := 0; i < len(canvases); {
+    cur := canvases[i]
+    // consecutive identical frames are merged, the disposal method depends on the next frame that differs
+    j, delay := i + 1, delays[i]
+    for ; j < len(canvases) && canvas.DiffRect(cur, canvases[j], canvas.Differs).Empty(); j++ { delay += delays[j] }
+
+    // GIF frames must not be empty, even if the canvas already shows the frame, e.g. after disposing the previous frame
+    rect := canvas.DiffRect(before, cur, canvas.Differs)
+    if rect.Empty() { rect = image.Rect(0, 0, 1, 1) }
+
+    disposal := byte(gif.DisposalNone)
+    if j < len(canvases) {
+      next := canvases[j]
+      // pixels can only be made transparent again by clearing them
+      if clear := canvas.DiffRect(cur, next, cleared); !clear.Empty() {
+        rect = rect.Union(clear)
+        disposal = gif.DisposalBackground
+      } else if canvas.DiffRect(before, next, cleared).Empty() && canvas.Area(canvas.DiffRect(before, next, canvas.Differs)) < canvas.Area(canvas.DiffRect(cur, next, canvas.Differs)) {
+        disposal = gif.DisposalPrevious
+      }
+    }
+    plans = append(plans, framePlan{ i, rect, disposal, delay })
+
+    switch disposal {
+    case gif.DisposalNone:
+      before = cur
+    case gif.DisposalBackground:
+      before = canvas.Clone(cur)
+      draw.Draw(before, rect, image.Transparent, image.Point{}, draw.Src)
+    }
+    i = j
+  }
+  return plans
+}
+
+// Used internally. Quantizes and remaps the frames according to plans.
+func encodeFrames(att *imagequant.Attributes, canvases []*image.NRGBA, plans []framePlan, opts *Options) (*gif.GIF, error) {
+  qimgs := make([]*imagequant.Image, len(plans))
+  defer func() {
+    for _, qimg := range qimgs { qimg.Close() }
+  }()
+  for i, plan := range plans {
+    qimg, err := att.NewImage(canvases[plan.index].SubImage(plan.rect), 0.0)
+    if err != nil { return nil, fmt.Errorf("frame %d: %w", plan.index, err) }
+    qimgs[i] = qimg
+    if err = att.AddImageFixedColor(qimg, transparent); err != nil { return nil, fmt.Errorf("frame %d: %w", plan.index, err) }
+  }
+
+  // global palette
+  var global *imagequant.Result
+  var globalPalette, globalColors color.Palette
+  if opts.Palette != PaletteLocal {
+    hist, err := att.NewHistogram()
+    if err != nil { return nil, err }
+    defer hist.Close()
+    for i, qimg := range qimgs {
+      if err = att.AddImageToHistogram(hist, qimg); err != nil { return nil, fmt.Errorf("frame %d: %w", plans[i].index, err) }
+    }
+    if global, err = att.QuantizeHistogram(hist); err != nil { return nil, err }
+    defer global.Close()
+    if err = att.SetDitheringLevel(global, opts.DitheringLevel); err != nil { return nil, err }
+    globalColors = att.GetPalette(global)
+    globalPalette = opaquePalette(globalColors)
+  }
+  minQuality := opts.MinQuality
+  if minQuality == 0 { minQuality = imagequant.QUALITY_GOOD }
+
+  g := &gif.GIF{
+    Image:      make([]*image.Paletted, len(plans)),
+    Delay:      make([]int, len(plans)),
+    Disposal:   make([]byte, len(plans)),
+    LoopCount:  opts.LoopCount,
+  }
+  usesGlobal := false
+  // actual content of the canvas before the current frame is drawn
+  shown := image.NewNRGBA(canvases[0].Bounds())
+  for i, plan := range plans {
+    qimg := qimgs[i]
+    if i > 0 {
+      bg, err := att.NewImage(shown.SubImage(plan.rect), 0.0)
+      if err != nil { return nil, fmt.Errorf("frame %d: %w", plan.index, err) }
+      err = att.SetImageBackground(qimg, bg)
+      // background is kept alive by qimg
+      bg.Close()
+      if err != nil { return nil, fmt.Errorf("frame %d: %w", plan.index, err) }
+    }
+
+    var pimg *image.Paletted
+    if global != nil {
+      img, err := att.WriteRemappedImage(global, qimg)
+      if err != nil { return nil, fmt.Errorf("frame %d: %w", plan.index, err) }
+      pimg = img.(*image.Paletted)
+      palette.Convert(pimg, globalColors)
+      pimg.Palette = globalPalette
+      if q := att.GetRemappingQuality(global); opts.Palette == PaletteAuto && q >= 0 && q < minQuality {
+        pimg = nil
+      }
+    }
+    if pimg == nil {
+      local, err := localFrame(att, qimg, opts.DitheringLevel)
+      if err != nil { return nil, fmt.Errorf("frame %d: %w", plan.index, err) }
+      pimg = local
+    } else {
+      usesGlobal = true
+    }
+
+    g.Image[i], g.Delay[i], g.Disposal[i] = pimg, plan.delay, plan.disposal
+
+    var prev *image.NRGBA
+    if plan.disposal == gif.DisposalPrevious { prev = canvas.Clone(shown) }
+    drawFrame(shown, pimg)
+    switch plan.disposal {
+    case gif.DisposalBackground:
+      draw.Draw(shown, plan.rect, image.Transparent, image.Point{}, draw.Src)
+    case gif.DisposalPrevious:
+      shown = prev
+    }
+  }
+
+  g.Config = image.Config{ Width: shown.Bounds().Dx(), Height: shown.Bounds().Dy() }
+  if usesGlobal {
+    g.Config.ColorModel = globalPalette
+    g.BackgroundIndex = byte(globalPalette.Index(transparent))
+  }
+  return g, nil
+}
+
+// Used internally. Quantizes and remaps a frame with its own palette.
+func localFrame(att *imagequant.Attributes, qimg *imagequant.Image, ditherLevel float32) (*image.Paletted, error) {
+  res, err := att.QuantizeImage(qimg)
+  if err != nil { return nil, err }
+  defer res.Close()
+  if err = att.SetDitheringLevel(res, ditherLevel); err != nil { return nil, err }
+  img, err := att.WriteRemappedImage(res, qimg)
+  if err != nil { return nil, err }
+  pimg := img.(*image.Paletted)
+  pimg.Palette = opaquePalette(pimg.Palette)
+  return pimg, nil
+}
+
+
+// Used internally. Converts img into a canvas with origin (0, 0). Translucent pixels are made fully opaque or fully transparent.
+func toCanvas(img image.Image) *image.NRGBA {
+  retVal := canvas.New(img)
+  for i := 0; i < len(retVal.Pix); i += 4 {
+    if retVal.Pix[i+3] < 0x80 {
+      retVal.Pix[i], retVal.Pix[i+1], retVal.Pix[i+2], retVal.Pix[i+3] = 0, 0, 0, 0
+    } else {
+      retVal.Pix[i+3] = 0xff
+    }
+  }
+  return retVal
+}
+
+// Used internally. Draws the non-transparent pixels of the frame onto the canvas. The palette must be fully opaque
+// except for transparent colors.
+func drawFrame(dst *image.NRGBA, frame *image.Paletted) {
+  b := frame.Bounds()
+  for y := b.Min.Y; y < b.Max.Y; y++ {
+    for x := b.Min.X; x < b.Max.X; x++ {
+      c := color.NRGBAModel.Convert(frame.Palette[frame.ColorIndexAt(x, y)]).(color.NRGBA)
+      if c.A != 0 { dst.SetNRGBA(x, y, c) }
+    }
+  }
+}
+
+// Used internally. Returns a copy of the palette with all colors made fully opaque, except for fully transparent colors.
+func opaquePalette(p color.Palette) color.Palette {
+  retVal := make(color.Palette, len(p))
+  for i, c := range p {
+    nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+    if nc.A == 0 {
+      retVal[i] = transparent
+    } else {
+      nc.A = 0xff
+      retVal[i] = nc
+    }
+  }
+  return retVal
+}
+
+// Used internally. Returns whether a visible pixel becomes transparent.
+func cleared(pa, pb []byte) bool {
+  return pa[3] != 0 && pb[3] == 0
+}
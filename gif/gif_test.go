@@ -0,0 +1,144 @@
+package gif
+
+import (
+  "bytes"
+  "image"
+  "image/color"
+  "image/draw"
+  "image/gif"
+  "testing"
+
+  "github.com/InfinityTools/go-imagequant/internal/canvas"
+)
+
+
+// Used internally. Returns a canvas of 16x16 blue pixels with the given rectangles filled with colors.
+func testCanvas(fills ...interface{}) *image.NRGBA {
+  c := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+  draw.Draw(c, c.Bounds(), image.NewUniform(color.NRGBA{ 0, 0, 255, 255 }), image.Point{}, draw.Src)
+  for i := 0; i < len(fills); i += 2 {
+    draw.Draw(c, fills[i].(image.Rectangle), image.NewUniform(fills[i+1].(color.Color)), image.Point{}, draw.Src)
+  }
+  return c
+}
+
+// Used internally. Returns frames covering all disposal methods, identical frames and frames that are already shown
+// after disposing the previous frame.
+func testFrames() ([]*image.NRGBA, []int) {
+  red, green := color.NRGBA{ 255, 0, 0, 255 }, color.NRGBA{ 0, 255, 0, 255 }
+  square := image.Rect(8, 8, 12, 12)
+  frames := []*image.NRGBA{
+    testCanvas(),
+    // disposed to the previous frame, since the next frame removes the sprite
+    testCanvas(image.Rect(2, 2, 6, 6), red),
+    testCanvas(),
+    // merged with the identical next frame and cleared, since the next different frame is transparent there
+    testCanvas(square, green),
+    testCanvas(square, green),
+    testCanvas(square, image.Transparent),
+    // unchanged pixels between the corners are made transparent by remapping with the background
+    testCanvas(square, image.Transparent, image.Rect(0, 0, 1, 1), red, image.Rect(15, 15, 16, 16), red),
+  }
+  return frames, []int{ 1, 2, 4, 8, 16, 32, 64 }
+}
+
+
+func TestPlanFrames(t *testing.T) {
+  frames, delays := testFrames()
+  want := []framePlan{
+    { 0, image.Rect(0, 0, 16, 16), gif.DisposalNone, 1 },
+    { 1, image.Rect(2, 2, 6, 6), gif.DisposalPrevious, 2 },
+    // the canvas already shows the frame
+    { 2, image.Rect(0, 0, 1, 1), gif.DisposalNone, 4 },
+    { 3, image.Rect(8, 8, 12, 12), gif.DisposalBackground, 8 + 16 },
+    { 5, image.Rect(0, 0, 1, 1), gif.DisposalNone, 32 },
+    { 6, image.Rect(0, 0, 16, 16), gif.DisposalNone, 64 },
+  }
+  got := planFrames(frames, delays)
+  if len(got) != len(want) { t.Fatalf("got %d frames %v, want %d", len(got), got, len(want)) }
+  for i := range want {
+    if got[i] != want[i] { t.Errorf("frame %d: got %+v, want %+v", i, got[i], want[i]) }
+  }
+
+  // GIF frames must not be empty
+  empty := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+  got = planFrames([]*image.NRGBA{ empty, empty }, []int{ 1, 2 })
+  if len(got) != 1 || got[0] != (framePlan{ 0, image.Rect(0, 0, 1, 1), gif.DisposalNone, 3 }) { t.Errorf("got %+v for empty frames", got) }
+}
+
+// Used internally. Renders the frames of g as a decoder does.
+func render(g *gif.GIF) []*image.NRGBA {
+  frames := make([]*image.NRGBA, len(g.Image))
+  shown := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+  for i, img := range g.Image {
+    prev := canvas.Clone(shown)
+    b := img.Bounds()
+    for y := b.Min.Y; y < b.Max.Y; y++ {
+      for x := b.Min.X; x < b.Max.X; x++ {
+        if c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA); c.A != 0 { shown.SetNRGBA(x, y, c) }
+      }
+    }
+    frames[i] = canvas.Clone(shown)
+    switch g.Disposal[i] {
+    case gif.DisposalBackground:
+      draw.Draw(shown, b, image.Transparent, image.Point{}, draw.Src)
+    case gif.DisposalPrevious:
+      shown = prev
+    }
+  }
+  return frames
+}
+
+// Used internally. Returns whether the color components differ by at most 2.
+func near(a, b []byte) bool {
+  for i := range a {
+    if d := int(a[i]) - int(b[i]); d < -2 || d > 2 { return false }
+  }
+  return true
+}
+
+func TestRoundTrip(t *testing.T) {
+  frames, delays := testFrames()
+  images := make([]image.Image, len(frames))
+  for i := range frames { images[i] = frames[i] }
+  plans := planFrames(frames, delays)
+
+  for _, mode := range []PaletteMode{ PaletteAuto, PaletteGlobal, PaletteLocal } {
+    g, err := Build(images, delays, &Options{ Palette: mode, LoopCount: 2 })
+    if err != nil { t.Fatalf("mode %d: %v", mode, err) }
+    if mode == PaletteLocal {
+      if g.Config.ColorModel != nil { t.Errorf("mode %d: got global palette", mode) }
+    } else if p, ok := g.Config.ColorModel.(color.Palette); !ok || int(g.BackgroundIndex) >= len(p) {
+      t.Errorf("mode %d: got global palette %v, background index %d", mode, g.Config.ColorModel, g.BackgroundIndex)
+    } else if _, _, _, a := p[g.BackgroundIndex].RGBA(); a != 0 {
+      t.Errorf("mode %d: got background color %v", mode, p[g.BackgroundIndex])
+    }
+
+    var buf bytes.Buffer
+    if err = gif.EncodeAll(&buf, g); err != nil { t.Fatalf("mode %d: %v", mode, err) }
+    h, err := gif.DecodeAll(&buf)
+    if err != nil { t.Fatalf("mode %d: %v", mode, err) }
+    if len(h.Image) != len(plans) || h.LoopCount != 2 { t.Fatalf("mode %d: got %d frames, %d loops", mode, len(h.Image), h.LoopCount) }
+
+    for i, plan := range plans {
+      if h.Delay[i] != plan.delay || h.Disposal[i] != plan.disposal || h.Image[i].Bounds() != plan.rect {
+        t.Errorf("mode %d, frame %d: got delay %d, disposal %d, bounds %v", mode, i, h.Delay[i], h.Disposal[i], h.Image[i].Bounds())
+      }
+    }
+    // unchanged pixels of the last frame are transparent
+    last := h.Image[len(h.Image)-1]
+    if _, _, _, a := last.At(4, 4).RGBA(); a != 0 { t.Errorf("mode %d: got color %v of unchanged pixel", mode, last.At(4, 4)) }
+
+    // decoded frames must render close to the source frames, transparent pixels must match exactly
+    for i, got := range render(h) {
+      want := frames[plans[i].index]
+      for j := 0; j < len(want.Pix); j += 4 {
+        opaque := want.Pix[j+3] != 0
+        if opaque != (got.Pix[j+3] != 0) || (opaque && !near(want.Pix[j:j+3], got.Pix[j:j+3])) {
+          t.Errorf("mode %d, frame %d: pixel %d differs from source", mode, i, j / 4)
+          break
+        }
+      }
+    }
+  }
+}
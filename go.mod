@@ -0,0 +1,3 @@
+module github.com/InfinityTools/go-imagequant
+
+go 1.21
@@ -14,22 +14,34 @@ import (
 
 // A HistogramEntry holds usage information of a single color value.
 type HistogramEntry struct {
-  Color     color.Color // The color value definition
+  Color     color.Color // The color value definition. Use the Color type to avoid conversion.
   Count     uint        // Number of occurrence, influences the weight or importance of the color.
 }
 
 // Histogram struct is required by several functions. Don't accss the content directly.
 type Histogram struct {
   histogram *C.struct_liq_histogram
+  lock      guard
 }
 
 
-// Creates a histogram object that will be used to collect color statistics from multiple images.
+// Creates a histogram object that will be used to collect color statistics from multiple images. Returns nil on failure.
 func (att *Attributes) CreateHistogram() *Histogram {
+  hist, _ := att.NewHistogram()
+  return hist
+}
+
+// Same as CreateHistogram, but returns an error describing the failure instead of nil.
+func (att *Attributes) NewHistogram() (*Histogram, error) {
+  if !att.acquire() { return nil, invalidPointer("liq_histogram_create") }
+  defer att.release()
   hist := new(Histogram)
-  hist.histogram = C.liq_histogram_create(att.attr)
+  att.account.run(func() { hist.histogram = C.liq_histogram_create(att.attr) })
+  if hist.histogram == nil { return nil, getError("liq_histogram_create", C.LIQ_OUT_OF_MEMORY) }
+  liveHistograms.Add(1)
+  hist.lock.open = true
   runtime.SetFinalizer(hist, freeHistogram)
-  return hist
+  return hist, nil
 }
 
 // "Learns" colors from the image, which will be later used to generate the palette.
@@ -37,36 +49,82 @@ func (att *Attributes) CreateHistogram() *Histogram {
 // After the image is added to the histogram it may be freed to save memory (but it's more efficient to keep the image object around if it's going to be used for remapping).
 // Fixed colors added to the image are also added to the histogram. If total number of fixed colors exceeds 256, this function will fail with ErrBufferTooSmall.
 func (att *Attributes) AddImageToHistogram(hist *Histogram, img *Image) error {
-  code := C.liq_histogram_add_image(hist.histogram, att.attr, img.image)
-  return getError(code)
+  if !att.acquire() { return invalidPointer("liq_histogram_add_image") }
+  defer att.release()
+  if !hist.acquireExclusive() { return invalidPointer("liq_histogram_add_image") }
+  defer hist.releaseExclusive()
+  if !img.acquireExclusive() { return invalidPointer("liq_histogram_add_image") }
+  defer img.releaseExclusive()
+  var code C.liq_error
+  att.account.run(func() { code = C.liq_histogram_add_image(hist.histogram, att.attr, img.image) })
+  return img.getError("liq_histogram_add_image", code)
 }
 
 // Alternative to AddImageToHistogram. Instead of counting colors in an image, it directly takes an array of colors and their counts. 
 //
 // This function is only useful if you already have a histogram of the image from another source.
+// Colors are converted to non-premultiplied 8-bit RGBA.
+//
+// Returns ErrInvalidPointer if entries is nil or empty.
 func (att *Attributes) AddColorsToHistogram(hist *Histogram, entries []HistogramEntry, gamma float64) error {
-  if entries == nil { return ErrInvalidPointer }
+  if len(entries) == 0 { return invalidPointer("liq_histogram_add_colors") }
+  if !att.acquire() { return invalidPointer("liq_histogram_add_colors") }
+  defer att.release()
+  if !hist.acquireExclusive() { return invalidPointer("liq_histogram_add_colors") }
+  defer hist.releaseExclusive()
   c_entries := make([]C.struct_liq_histogram_entry, len(entries))
   for k, v := range entries {
-    r, g, b, a := v.Color.RGBA()
-    c_entries[k].color.r = C.uchar(r)
-    c_entries[k].color.g = C.uchar(g)
-    c_entries[k].color.b = C.uchar(b)
-    c_entries[k].color.a = C.uchar(a)
+    c_entries[k].color = toLiqColor(v.Color)
     c_entries[k].count = C.uint(v.Count)
   }
-  code := C.liq_histogram_add_colors(hist.histogram, att.attr, 
-                                     (*C.struct_liq_histogram_entry)(unsafe.Pointer(&c_entries[0])), 
-                                     C.int(len(c_entries)), C.double(gamma))
-  return getError(code)
+  var code C.liq_error
+  att.account.run(func() {
+    code = C.liq_histogram_add_colors(hist.histogram, att.attr, 
+                                      (*C.struct_liq_histogram_entry)(unsafe.Pointer(&c_entries[0])), 
+                                      C.int(len(c_entries)), C.double(gamma))
+  })
+  return getError("liq_histogram_add_colors", code)
+}
+
+
+// Close releases the histogram. It implements the io.Closer interface and always returns nil.
+//
+// Calling Close more than once has no effect. Close waits for functions using the histogram in other goroutines to complete.
+// Functions called with a closed histogram return ErrInvalidPointer. Otherwise the histogram is released by the garbage collector eventually.
+func (hist *Histogram) Close() error {
+  if hist == nil { return nil }
+  hist.lock.close(func() { freeHistogram(hist) })
+  runtime.SetFinalizer(hist, nil)
+  return nil
 }
 
 
+// Used internally. Acquires shared access to the object. Returns false if the object is not available.
+func (hist *Histogram) acquire() bool {
+  return hist != nil && hist.lock.acquire()
+}
+
+// Used internally. Releases shared access to the object.
+func (hist *Histogram) release() {
+  hist.lock.release()
+}
+
+// Used internally. Acquires exclusive access to the object. Returns false if the object is not available.
+func (hist *Histogram) acquireExclusive() bool {
+  return hist != nil && hist.lock.acquireExclusive()
+}
+
+// Used internally. Releases exclusive access to the object.
+func (hist *Histogram) releaseExclusive() {
+  hist.lock.releaseExclusive()
+}
+
 // Used internally. Frees a Histogram object.
 func freeHistogram(h *Histogram) {
   if h.histogram != nil {
     // fmt.Println("Releasing Histogram object.")
     C.liq_histogram_destroy(h.histogram)
     h.histogram = nil
+    liveHistograms.Add(-1)
   }
 }
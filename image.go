@@ -1,7 +1,14 @@
 package imagequant
 
 /*
+#include <stdint.h>
 #include "libimagequant.h"
+
+extern void goImageRowCallback(liq_color*, int, int, void*);
+
+static liq_image *createImageCustom(const liq_attr *attr, uintptr_t handle, int width, int height, double gamma) {
+  return liq_image_create_custom(attr, (liq_image_get_rgba_row_callback*)goImageRowCallback, (void*)handle, width, height, gamma);
+}
 */
 import "C"
 
@@ -9,15 +16,27 @@ import (
   "image"
   "image/color"
   "runtime"
+  "sync"
   "unsafe"
 )
 
 
+// Used internally. Guards the background field of all images, so that chains of background images can be traversed
+// without holding the locks of the images.
+var backgroundMu sync.Mutex
+
 // Image struct is required by several functions. Don't access the content directly.
 type Image struct {
   image     *C.struct_liq_image
+  lock        guard
+  background  *Image    // referenced by the library until the image is freed
+  dependents  int       // number of images that use this image as background
   buffer      []byte    // set to prevent GC from cleaning up pixel buffer prematurely
   bufferRows  [][]byte  // set to prevent GC from cleaning up pixel buffer prematurely
+  rowPtr      []uintptr // row pointers are referenced by the library until the image is freed
+  pinner      runtime.Pinner // pins Go memory referenced by the library until the image is freed
+  rowHandle   uintptr   // callback handle of images created by CreateImageFromRows
+  bounds      image.Rectangle // region of the source image
 }
 
 
@@ -25,7 +44,8 @@ type Image struct {
 //
 // The pixel array must be contiguous run of RGBA pixels (alpha is the last component, 0 = transparent, 255 = opaque).
 //
-// The rgba array must not be modified or freed until this object is freed with liq_image_destroy. See also liq_image_set_memory_ownership.
+// The rgba array must not be modified or freed until this object is freed with Close. It is pinned (see runtime.Pinner) 
+// while the library refers to it.
 //
 // width and height are dimensions in pixels. An image 10x10 pixel large will need a 400-byte array.
 //
@@ -36,15 +56,37 @@ type Image struct {
 //
 // Returns nil on failure, e.g. if rgba is nil or too small or width/height is <= 0.
 func (att *Attributes) CreateImageBuffer(rgba []byte, width, height int, gamma float64) *Image {
-  if width < 0 || height < 0 { return nil }
-  if rgba == nil || len(rgba) < width*height*4 { return nil }
+  img, _ := att.NewImageBuffer(rgba, width, height, gamma)
+  return img
+}
+
+// Same as CreateImageBuffer, but returns an error describing the failure instead of nil.
+//
+// Returns an *Error wrapping ErrValueOutOfRange if width/height is <= 0, ErrInvalidPointer if rgba is nil, ErrBufferTooSmall 
+// if rgba is too small and ErrOutOfMemory if the library could not create the image, e.g. because it is too large.
+func (att *Attributes) NewImageBuffer(rgba []byte, width, height int, gamma float64) (*Image, error) {
+  const op = "liq_image_create_rgba"
+  if !att.acquire() { return nil, invalidPointer(op) }
+  defer att.release()
+  if width <= 0 || height <= 0 { return nil, getImageError(op, C.LIQ_VALUE_OUT_OF_RANGE, width, height) }
+  if rgba == nil { return nil, getImageError(op, C.LIQ_INVALID_POINTER, width, height) }
+  if len(rgba) < width*height*4 { return nil, getImageError(op, C.LIQ_BUFFER_TOO_SMALL, width, height) }
   // img := Image{ nil }
   img := new(Image)
-  img.image = C.liq_image_create_rgba(att.attr, unsafe.Pointer(&rgba[0]), C.int(width), C.int(height), C.double(gamma))
-  if img.image == nil { return nil }
+  img.pinner.Pin(&rgba[0])
+  att.account.run(func() {
+    img.image = C.liq_image_create_rgba(att.attr, unsafe.Pointer(&rgba[0]), C.int(width), C.int(height), C.double(gamma))
+  })
+  if img.image == nil {
+    img.pinner.Unpin()
+    return nil, getImageError(op, C.LIQ_OUT_OF_MEMORY, width, height)
+  }
+  liveImages.Add(1)
   img.buffer = rgba
+  img.bounds = image.Rect(0, 0, width, height)
+  img.lock.open = true
   runtime.SetFinalizer(img, freeImage)
-  return img
+  return img, nil
 }
 
 // Same as CreateImageBuffer, but takes an array of rows of pixels.
@@ -52,28 +94,106 @@ func (att *Attributes) CreateImageBuffer(rgba []byte, width, height int, gamma f
 // This allows defining images with reversed rows (like in BMP), "stride" different than width or using only fragment of a larger bitmap, etc.
 // The rows array must have at least height elements, and each row must be at least width RGBA pixels wide.
 func (att *Attributes) CreateImageBufferRows(rgbaRows [][]byte, width, height int, gamma float64) *Image {
-  if width < 0 || height < 0 { return nil }
-  if rgbaRows == nil || len(rgbaRows) < height { return nil }
+  img, _ := att.NewImageBufferRows(rgbaRows, width, height, gamma)
+  return img
+}
+
+// Same as CreateImageBufferRows, but returns an error describing the failure instead of nil. See NewImageBuffer for details.
+func (att *Attributes) NewImageBufferRows(rgbaRows [][]byte, width, height int, gamma float64) (*Image, error) {
+  const op = "liq_image_create_rgba_rows"
+  if !att.acquire() { return nil, invalidPointer(op) }
+  defer att.release()
+  if width <= 0 || height <= 0 { return nil, getImageError(op, C.LIQ_VALUE_OUT_OF_RANGE, width, height) }
+  if rgbaRows == nil { return nil, getImageError(op, C.LIQ_INVALID_POINTER, width, height) }
+  if len(rgbaRows) < height { return nil, getImageError(op, C.LIQ_BUFFER_TOO_SMALL, width, height) }
 
   // img := Image{ nil }
   img := new(Image)
   rowPtr := make([]uintptr, len(rgbaRows))
   for i := 0; i < len(rgbaRows); i++ {
-    if rgbaRows[i] == nil || len(rgbaRows[i]) < width * 4 { return nil }
+    if rgbaRows[i] == nil { return nil, getImageError(op, C.LIQ_INVALID_POINTER, width, height) }
+    if len(rgbaRows[i]) < width * 4 { return nil, getImageError(op, C.LIQ_BUFFER_TOO_SMALL, width, height) }
     rowPtr[i] = uintptr(unsafe.Pointer(&rgbaRows[i][0]))
   }
-  img.image = C.liq_image_create_rgba_rows(att.attr, (*unsafe.Pointer)(unsafe.Pointer(&rowPtr[0])), C.int(width), C.int(height), C.double(gamma))
-  if img.image == nil { return nil }
+  // row pointers are hidden from the garbage collector, both the array and the rows are pinned instead
+  for i := 0; i < len(rgbaRows); i++ { img.pinner.Pin(&rgbaRows[i][0]) }
+  img.pinner.Pin(&rowPtr[0])
+  att.account.run(func() {
+    img.image = C.liq_image_create_rgba_rows(att.attr, (*unsafe.Pointer)(unsafe.Pointer(&rowPtr[0])), C.int(width), C.int(height), C.double(gamma))
+  })
+  if img.image == nil {
+    img.pinner.Unpin()
+    return nil, getImageError(op, C.LIQ_OUT_OF_MEMORY, width, height)
+  }
+  liveImages.Add(1)
   img.bufferRows = rgbaRows
+  img.rowPtr = rowPtr
+  img.bounds = image.Rect(0, 0, width, height)
+  img.lock.open = true
   runtime.SetFinalizer(img, freeImage)
-  return img
+  return img, nil
 }
 
 // Same as CreateImageBuffer, but takes a Go Image interface as source.
+//
+// Only the region defined by the image bounds is used. Bounds are preserved by WriteRemappedImage.
+// Premultiplied colors of the source image are converted to the non-premultiplied RGBA format expected by the library.
+// Pixel data of *image.NRGBA images is used directly without creating a copy. Such images must not be modified until the 
+// returned object is freed, and their pixel data is pinned in the meantime (see CreateImageBuffer). Images of type *image.RGBA, *image.NRGBA64, *image.Gray, *image.YCbCr and *image.Paletted 
+// are converted without going through the generic color interface.
 func (att *Attributes) CreateImage(img image.Image, gamma float64) *Image {
-  buf := imageToBytes32(img)
+  retVal, _ := att.NewImage(img, gamma)
+  return retVal
+}
+
+// Same as CreateImage, but returns an error describing the failure instead of nil. See NewImageBuffer for details.
+func (att *Attributes) NewImage(img image.Image, gamma float64) (retVal *Image, err error) {
   width, height := img.Bounds().Dx(), img.Bounds().Dy()
-  return att.CreateImageBuffer(buf, width, height, gamma)
+  if width <= 0 || height <= 0 { return nil, getImageError("liq_image_create_rgba", C.LIQ_VALUE_OUT_OF_RANGE, width, height) }
+  if src, ok := img.(*image.NRGBA); ok {
+    retVal, err = att.NewImageBufferRows(nrgbaRows(src), width, height, gamma)
+  } else {
+    retVal, err = att.NewImageBuffer(imageToBytes32(img), width, height, gamma)
+  }
+  if retVal != nil { retVal.bounds = img.Bounds() }
+  return
+}
+
+// Creates an image object that requests pixel data row by row from the given callback function instead of 
+// keeping a copy of the whole image in memory.
+//
+// rowFunc is called whenever the library needs pixel data for row y. It must fill dst (width pixels) with 
+// non-premultiplied colors. The function may be called multiple times for the same row and from threads other 
+// than the calling thread, so it must be safe for concurrent use. dst must not be retained after rowFunc returns.
+//
+// See CreateImageBuffer for the meaning of gamma. Returns nil on failure, e.g. if rowFunc is nil or width/height is <= 0.
+func (att *Attributes) CreateImageFromRows(width, height int, gamma float64, rowFunc func(y int, dst []color.NRGBA)) *Image {
+  img, _ := att.NewImageFromRows(width, height, gamma, rowFunc)
+  return img
+}
+
+// Same as CreateImageFromRows, but returns an error describing the failure instead of nil. See NewImageBuffer for details.
+func (att *Attributes) NewImageFromRows(width, height int, gamma float64, rowFunc func(y int, dst []color.NRGBA)) (*Image, error) {
+  const op = "liq_image_create_custom"
+  if !att.acquire() { return nil, invalidPointer(op) }
+  defer att.release()
+  if width <= 0 || height <= 0 { return nil, getImageError(op, C.LIQ_VALUE_OUT_OF_RANGE, width, height) }
+  if rowFunc == nil { return nil, getImageError(op, C.LIQ_INVALID_POINTER, width, height) }
+
+  img := new(Image)
+  img.rowHandle = registerCallback(RowCallback(rowFunc))
+  att.account.run(func() {
+    img.image = C.createImageCustom(att.attr, C.uintptr_t(img.rowHandle), C.int(width), C.int(height), C.double(gamma))
+  })
+  if img.image == nil {
+    unregisterCallback(img.rowHandle)
+    return nil, getImageError(op, C.LIQ_OUT_OF_MEMORY, width, height)
+  }
+  liveImages.Add(1)
+  img.bounds = image.Rect(0, 0, width, height)
+  img.lock.open = true
+  runtime.SetFinalizer(img, freeImage)
+  return img, nil
 }
 
 // Analyze and remap this image with assumption that it will be always presented exactly on top of this background.
@@ -82,10 +202,41 @@ func (att *Attributes) CreateImage(img image.Image, gamma float64) *Image {
 // pixels that are better represented by the background than the palette will be made transparent. This function can 
 // be used to improve quality of animated GIFs by setting previous animation frame as the background.
 //
+// The background image is kept alive until img is released, even if Close is called on the background image.
+//
 // Returns ErrBufferTooSmall if the background image has a different size than the foreground.
+// Returns ErrUnsupported if img and background refer to the same object, or if img is already used as background of
+// background, directly or through other images.
 func (att *Attributes) SetImageBackground(img *Image, background *Image) error {
+  if img == background { return getError("SetImageBackground", C.LIQ_UNSUPPORTED) }
+  if img == nil || background == nil || !acquireExclusivePair(&img.lock, &background.lock) {
+    return invalidPointer("liq_image_set_background")
+  }
+  old, err := img.setBackground(background)
+  img.releaseExclusive()
+  background.releaseExclusive()
+  // the previous background is released without holding any locks, it may be in use by other images
+  if old != nil { old.removeDependent() }
+  return err
+}
+
+// Used internally. Implements SetImageBackground. Returns the previous background image if it has been replaced.
+// Exclusive access to img and background must be held by the caller.
+func (img *Image) setBackground(background *Image) (*Image, error) {
+  backgroundMu.Lock()
+  defer backgroundMu.Unlock()
+  // a cycle would let remapping functions acquire the images in opposite order
+  for b := background; b != nil; b = b.background {
+    if b == img { return nil, getError("SetImageBackground", C.LIQ_UNSUPPORTED) }
+  }
   code := C.liq_image_set_background(img.image, background.image)
-  return getError(code)
+  if err := img.getError("liq_image_set_background", code); err != nil { return nil, err }
+
+  if img.background == background { return nil, nil }
+  old := img.background
+  img.background = background
+  background.dependents++
+  return old, nil
 }
 
 // Importance map controls which areas of the image get more palette colors.
@@ -96,8 +247,16 @@ func (att *Attributes) SetImageBackground(img *Image, background *Image) error {
 //
 // Returns ErrInvalidPointer if any pointer is nil and ErrBufferTooSmall if the map size does not match the image size.
 func (att *Attributes) SetImageImportanceMap(img *Image, importanceMap []byte) error {
-  code := C.liq_image_set_importance_map(img.image, (*C.uchar)(unsafe.Pointer(&importanceMap[0])), C.size_t(len(importanceMap)), C.LIQ_COPY_PIXELS)
-  return getError(code)
+  if len(importanceMap) == 0 { return invalidPointer("liq_image_set_importance_map") }
+  account := att.retainAccount()
+  defer account.release()
+  if !img.acquireExclusive() { return invalidPointer("liq_image_set_importance_map") }
+  defer img.releaseExclusive()
+  var code C.liq_error
+  account.run(func() {
+    code = C.liq_image_set_importance_map(img.image, (*C.uchar)(unsafe.Pointer(&importanceMap[0])), C.size_t(len(importanceMap)), C.LIQ_COPY_PIXELS)
+  })
+  return img.getError("liq_image_set_importance_map", code)
 }
 
 // Reserves a color in the output palette created from this image.
@@ -105,25 +264,115 @@ func (att *Attributes) SetImageImportanceMap(img *Image, importanceMap []byte) e
 // It behaves as if the given color was used in the image and was very important.
 // RGB values of the Color object are assumed to have the same gamma as the image. It must be called before the image is quantized.
 //
+// The color is converted to non-premultiplied 8-bit RGBA. Use the Color type to specify the exact color value without conversion.
+//
 // Returns error if more than 256 colors are added. If image is quantized to fewer colors than the number of fixed colors added, then excess fixed colors will be ignored.
 func (att *Attributes) AddImageFixedColor(img *Image, col color.Color) error {
-  r, g, b, a := col.RGBA()
-  c := C.struct_liq_color{}
-  c.r, c.g, c.b, c.a = C.uchar(r), C.uchar(g), C.uchar(b), C.uchar(a)
-  code := C.liq_image_add_fixed_color(img.image, c)
-  return getError(code)
+  if !img.acquireExclusive() { return invalidPointer("liq_image_add_fixed_color") }
+  defer img.releaseExclusive()
+  code := C.liq_image_add_fixed_color(img.image, toLiqColor(col))
+  return img.getError("liq_image_add_fixed_color", code)
 }
 
 // Getter for image width.
 func (att *Attributes) GetImageWidth(img *Image) int {
+  if !img.acquire() { return -1 }
+  defer img.release()
   return int(C.liq_image_get_width(img.image))
 }
 
 // Getter for image height.
 func (att *Attributes) GetImageHeight(img *Image) int {
+  if !img.acquire() { return -1 }
+  defer img.release()
   return int(C.liq_image_get_height(img.image))
 }
 
+// Getter for image bounds. Returns the bounds of the source image if the image was created by CreateImage.
+// Otherwise the returned rectangle has its origin at (0, 0). Returns an empty rectangle if the image has been closed.
+func (att *Attributes) GetImageBounds(img *Image) image.Rectangle {
+  if !img.acquire() { return image.Rectangle{} }
+  defer img.release()
+  return img.bounds
+}
+
+
+// Close releases the image. It implements the io.Closer interface and always returns nil.
+//
+// Calling Close more than once has no effect. Close waits for functions using the image in other goroutines to complete.
+// Functions called with a closed image return ErrInvalidPointer, or -1 if they only return a numeric value.
+// Otherwise the image is released by the garbage collector eventually.
+//
+// Resources of an image that is used as background of other images (see SetImageBackground) are released when 
+// all of these images have been released.
+func (img *Image) Close() error {
+  if img == nil { return nil }
+  img.lock.close(func() {
+    if img.dependents == 0 { freeImage(img) }
+  })
+  runtime.SetFinalizer(img, nil)
+  return nil
+}
+
+
+// Used internally. Acquires shared access to the object. Returns false if the object is not available.
+func (img *Image) acquire() bool {
+  return img != nil && img.lock.acquire()
+}
+
+// Used internally. Releases shared access to the object.
+func (img *Image) release() {
+  img.lock.release()
+}
+
+// Used internally. Acquires exclusive access to the object. Returns false if the object is not available.
+func (img *Image) acquireExclusive() bool {
+  return img != nil && img.lock.acquireExclusive()
+}
+
+// Used internally. Releases exclusive access to the object.
+func (img *Image) releaseExclusive() {
+  img.lock.releaseExclusive()
+}
+
+// Used internally. Same as getError, but includes the image dimensions. Access to the image must be held by the caller.
+func (img *Image) getError(op string, code C.liq_error) error {
+  if code == C.LIQ_OK { return nil }
+  return getImageError(op, code, int(C.liq_image_get_width(img.image)), int(C.liq_image_get_height(img.image)))
+}
+
+// Used internally. Called when a foreground image no longer uses this image as background.
+// Frees the image if it has been closed and is not used by any other image.
+func (img *Image) removeDependent() {
+  img.lock.mu.Lock()
+  defer img.lock.mu.Unlock()
+  img.dependents--
+  if !img.lock.open && img.dependents == 0 { freeImage(img) }
+}
+
+// Used internally. Wraps the background image of img for acquireAll and releaseAll, which acquire and release exclusive
+// access to it. The background image remains accessible after it has been closed. Exclusive access to img must be 
+// acquired first.
+type backgroundLock struct {
+  img *Image
+}
+
+// Used internally. Acquires exclusive access to the background image, if any.
+func (b backgroundLock) acquire() bool {
+  if b.img.background != nil { b.img.background.lock.mu.Lock() }
+  return true
+}
+
+// Used internally. Releases exclusive access to the background image, if any.
+func (b backgroundLock) release() {
+  if b.img.background != nil { b.img.background.lock.mu.Unlock() }
+}
+
+// Used internally. Converts a Go color into a liq_color structure.
+func toLiqColor(col color.Color) C.struct_liq_color {
+  c := toColor(col)
+  return C.struct_liq_color{ r: C.uchar(c.R), g: C.uchar(c.G), b: C.uchar(c.B), a: C.uchar(c.A) }
+}
 
 // Used internally. Frees an Image object.
 func freeImage(i *Image) {
@@ -133,5 +382,15 @@ func freeImage(i *Image) {
     i.image = nil
     i.buffer = nil
     i.bufferRows = nil
+    i.rowPtr = nil
+    i.pinner.Unpin()
+    unregisterCallback(i.rowHandle)
+    i.rowHandle = 0
+    backgroundMu.Lock()
+    bg := i.background
+    i.background = nil
+    backgroundMu.Unlock()
+    if bg != nil { bg.removeDependent() }
+    liveImages.Add(-1)
   }
 }
@@ -0,0 +1,171 @@
+package imagequant
+
+import (
+  "image"
+  "image/color"
+  "image/color/palette"
+  "image/draw"
+  "testing"
+)
+
+
+// Used internally. Returns a gradient of translucent colors with less than 256 distinct colors. Each row has its own
+// color, alpha increases from left to right.
+func translucentImage() *image.NRGBA {
+  colors := []color.NRGBA{ { 200, 100, 50, 0 }, { 20, 220, 90, 0 }, { 255, 255, 255, 0 }, { 90, 40, 250, 0 } }
+  img := image.NewNRGBA(image.Rect(0, 0, 32, len(colors)))
+  for y, c := range colors {
+    for x := 0; x < 32; x++ {
+      c.A = uint8(32 + x * 7)
+      img.SetNRGBA(x, y, c)
+    }
+  }
+  return img
+}
+
+// Used internally. Quantizes and remaps img without dithering.
+func remapImage(t *testing.T, img image.Image) *image.Paletted {
+  t.Helper()
+  att := CreateAttributes()
+  defer att.Release()
+  qimg, err := att.NewImage(img, 0)
+  if err != nil { t.Fatal(err) }
+  defer qimg.Close()
+  res, err := att.QuantizeImage(qimg)
+  if err != nil { t.Fatal(err) }
+  defer res.Close()
+  if err = att.SetDitheringLevel(res, 0); err != nil { t.Fatal(err) }
+  imgOut, err := att.WriteRemappedImage(res, qimg)
+  if err != nil { t.Fatal(err) }
+  for i, c := range imgOut.(*image.Paletted).Palette {
+    if _, ok := c.(color.NRGBA); !ok { t.Fatalf("palette entry %d: got %T, want color.NRGBA", i, c) }
+  }
+  return imgOut.(*image.Paletted)
+}
+
+// Used internally. Checks whether the pixels of got match the pixels of want. Color components may differ by
+// tolerance, alpha by 1.
+func compareImages(t *testing.T, got, want image.Image, tolerance int) {
+  t.Helper()
+  if got.Bounds() != want.Bounds() { t.Fatalf("got bounds %v, want %v", got.Bounds(), want.Bounds()) }
+  diff := func(a, b uint8) int {
+    if a > b { return int(a - b) }
+    return int(b - a)
+  }
+  b := want.Bounds()
+  for y := b.Min.Y; y < b.Max.Y; y++ {
+    for x := b.Min.X; x < b.Max.X; x++ {
+      g := color.NRGBAModel.Convert(got.At(x, y)).(color.NRGBA)
+      w := color.NRGBAModel.Convert(want.At(x, y)).(color.NRGBA)
+      if diff(g.R, w.R) > tolerance || diff(g.G, w.G) > tolerance || diff(g.B, w.B) > tolerance || diff(g.A, w.A) > 1 {
+        t.Fatalf("pixel (%d, %d): got %v, want %v", x, y, g, w)
+      }
+    }
+  }
+}
+
+
+func TestTranslucentRoundTrip(t *testing.T) {
+  src := translucentImage()
+  compareImages(t, remapImage(t, src), src, 2)
+
+  // premultiplied input must not be darkened
+  rgba := image.NewRGBA(src.Bounds())
+  draw.Draw(rgba, rgba.Bounds(), src, image.Point{}, draw.Src)
+  compareImages(t, remapImage(t, rgba), rgba, 2)
+
+  nrgba64 := image.NewNRGBA64(src.Bounds())
+  draw.Draw(nrgba64, nrgba64.Bounds(), src, image.Point{}, draw.Src)
+  compareImages(t, remapImage(t, nrgba64), src, 2)
+}
+
+func TestOffsetBounds(t *testing.T) {
+  full := gradientImage(16, 16)
+  rect := image.Rect(3, 5, 11, 9)
+  sub := full.SubImage(rect)
+
+  // image with the same content and a non-zero origin that doesn't share its buffer with another image
+  offset := image.NewRGBA(rect)
+  draw.Draw(offset, rect, full, rect.Min, draw.Src)
+
+  gray := image.NewGray(full.Bounds())
+  draw.Draw(gray, gray.Bounds(), full, image.Point{}, draw.Src)
+
+  for _, src := range []image.Image{ sub, offset, gray.SubImage(rect) } {
+    out := remapImage(t, src)
+    if out.Rect != rect { t.Fatalf("%T: got bounds %v, want %v", src, out.Rect, rect) }
+    compareImages(t, out, src, 1)
+  }
+
+  att := CreateAttributes()
+  defer att.Release()
+  qimg, err := att.NewImage(sub, 0)
+  if err != nil { t.Fatal(err) }
+  defer qimg.Close()
+  if b := att.GetImageBounds(qimg); b != rect { t.Errorf("got image bounds %v, want %v", b, rect) }
+  if w, h := att.GetImageWidth(qimg), att.GetImageHeight(qimg); w != rect.Dx() || h != rect.Dy() {
+    t.Errorf("got image size %dx%d, want %dx%d", w, h, rect.Dx(), rect.Dy())
+  }
+}
+
+
+// Used internally. Measures NewImage with a 512x512 image of the given type.
+func benchmarkNewImage(b *testing.B, img draw.Image) {
+  draw.Draw(img, img.Bounds(), translucentImage(), image.Point{}, draw.Src)
+  draw.Draw(img, img.Bounds().Add(image.Pt(0, 4)), gradientImage(512, 508), image.Point{}, draw.Src)
+  att := CreateAttributes()
+  defer att.Release()
+  b.SetBytes(int64(img.Bounds().Dx() * img.Bounds().Dy() * 4))
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    qimg, err := att.NewImage(img, 0)
+    if err != nil { b.Fatal(err) }
+    qimg.Close()
+  }
+}
+
+func BenchmarkNewImageNRGBA(b *testing.B) {
+  benchmarkNewImage(b, image.NewNRGBA(image.Rect(0, 0, 512, 512)))
+}
+
+func BenchmarkNewImageRGBA(b *testing.B) {
+  benchmarkNewImage(b, image.NewRGBA(image.Rect(0, 0, 512, 512)))
+}
+
+func BenchmarkNewImageNRGBA64(b *testing.B) {
+  benchmarkNewImage(b, image.NewNRGBA64(image.Rect(0, 0, 512, 512)))
+}
+
+func BenchmarkNewImageGray(b *testing.B) {
+  benchmarkNewImage(b, image.NewGray(image.Rect(0, 0, 512, 512)))
+}
+
+func BenchmarkNewImageYCbCr(b *testing.B) {
+  // YCbCr images are not drawable, the luma plane is filled directly
+  img := image.NewYCbCr(image.Rect(0, 0, 512, 512), image.YCbCrSubsampleRatio420)
+  for i := range img.Y { img.Y[i] = uint8(i) }
+  for i := range img.Cb { img.Cb[i], img.Cr[i] = uint8(i >> 3), uint8(i >> 5) }
+  att := CreateAttributes()
+  defer att.Release()
+  b.SetBytes(512 * 512 * 4)
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    qimg, err := att.NewImage(img, 0)
+    if err != nil { b.Fatal(err) }
+    qimg.Close()
+  }
+}
+
+func BenchmarkNewImagePaletted(b *testing.B) {
+  benchmarkNewImage(b, image.NewPaletted(image.Rect(0, 0, 512, 512), palette.Plan9))
+}
+
+// Reference for the conversions above: the generic path through the color.Color interface.
+func BenchmarkNewImageGeneric(b *testing.B) {
+  benchmarkNewImage(b, &genericImage{ image.NewNRGBA64(image.Rect(0, 0, 512, 512)) })
+}
+
+// Used internally. Hides the concrete type of the embedded image.
+type genericImage struct {
+  *image.NRGBA64
+}
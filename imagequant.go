@@ -2,15 +2,32 @@
 Package imagequant provides bindings to the external imagequant C library.
 
 Original C library: https://github.com/ImageOptim/libimagequant/
+
+Concurrency
+
+Attributes, Image, Histogram and Result objects may be shared by multiple goroutines. All functions synchronize access 
+to the objects involved internally:
+
+  - Functions that only read an object, such as the getters of Attributes and Result or GetImageWidth, may run 
+    concurrently with each other.
+  - Functions that modify an object wait for all other functions using the same object to complete. Besides the setters 
+    this includes operations that update internal state of the library: quantizing an image modifies the Image, adding 
+    an image to a histogram modifies the Histogram and the Image, and remapping an image modifies the Result (the 
+    palette is refined during remapping), the Image and its background image. GetPalette modifies the Result as well, 
+    since the palette is finalized on first access.
+  - Close waits for all functions using the object to complete. Functions called with a closed object fail with 
+    ErrInvalidPointer.
+
+As a consequence, remapping multiple images with one shared Result object is safe, but the remapping operations are 
+performed one after another. WriteRemappedImage returns the palette matching the remapped pixels, even if the palette 
+is refined concurrently by other goroutines. To process multiple images in parallel use separate Result objects, 
+e.g. by using a Batch or separate copies of the Attributes object (see CopyAttribute).
+
+Callback functions are called by the library while the objects involved are in use. They must not modify or release 
+these objects.
 */
 package imagequant
 // Alternative Go binding package (by larrabee): https://github.com/ultimate-guitar/go-imagequant
-// TODO: Attempt to implement callback support:
-// - liq_set_log_callback
-// - liq_set_log_flush_callback
-// - liq_attr_set_progress_callback
-// - liq_result_set_progress_callback
-// - liq_image_create_custom
 
 /*
 // CGO linker flags are defined for selected platforms windows/linux/freebsd/darwin and architectures 386/amd64.
@@ -34,6 +51,7 @@ import "C"
 
 import (
   "errors"
+  "fmt"
 )
 
 
@@ -68,8 +86,53 @@ func GetVersionString() string {
 }
 
 
+// Error describes a failed library operation. It wraps one of the ErrXxx error values, so that 
+// errors.Is can be used to check for specific error conditions, e.g. errors.Is(err, ErrQualityTooLow).
+type Error struct {
+  Op      string  // Name of the library function or method that failed, e.g. "liq_image_quantize" or "SearchImage"
+  Code    int     // Raw liq_error code of the library, or -1 if no code matches the error
+  Width   int     // Width of the image involved in the operation, or 0 if not available
+  Height  int     // Height of the image involved in the operation, or 0 if not available
+  Err     error   // Error value associated with Code
+}
+
+func (e *Error) Error() string {
+  if e.Width > 0 || e.Height > 0 {
+    return fmt.Sprintf("%s: %s (image %dx%d)", e.Op, e.Err, e.Width, e.Height)
+  }
+  return fmt.Sprintf("%s: %s", e.Op, e.Err)
+}
+
+// Unwrap returns the error value associated with the error code.
+func (e *Error) Unwrap() error {
+  return e.Err
+}
+
+
+// Used internally. Translates the result of a library operation to an *Error object. Returns nil if code indicates success.
+func getError(op string, code C.liq_error) error {
+  return getImageError(op, code, 0, 0)
+}
+
+// Used internally. Same as getError, but includes the dimensions of the image involved in the operation.
+func getImageError(op string, code C.liq_error, width, height int) error {
+  if code == C.LIQ_OK { return nil }
+  return &Error{ Op: op, Code: int(code), Width: width, Height: height, Err: codeToError(code) }
+}
+
+// Used internally. Returns an *Error wrapping ErrInvalidPointer for the given operation.
+func invalidPointer(op string) error {
+  return getError(op, C.LIQ_INVALID_POINTER)
+}
+
+// Used internally. Returns an *Error for a failure detected by the package itself. err must be one of the error values
+// of the package, it is wrapped together with a description of the failure given by format and a.
+func newError(op string, err error, format string, a ...interface{}) error {
+  return &Error{ Op: op, Code: errorToCode(err), Err: fmt.Errorf(format + ": %w", append(a, err)...) }
+}
+
 // Used internally. Translates error codes to Golang errors.
-func getError(code C.liq_error) error {
+func codeToError(code C.liq_error) error {
   switch code {
   case C.LIQ_OK:
     return nil
@@ -93,3 +156,29 @@ func getError(code C.liq_error) error {
     return ErrUnknown
   }
 }
+
+// Used internally. Translates Golang errors to error codes. Reverse of codeToError, returns -1 for ErrUnknown.
+func errorToCode(err error) int {
+  switch err {
+  case nil:
+    return int(C.LIQ_OK)
+  case ErrQualityTooLow:
+    return int(C.LIQ_QUALITY_TOO_LOW)
+  case ErrValueOutOfRange:
+    return int(C.LIQ_VALUE_OUT_OF_RANGE)
+  case ErrOutOfMemory:
+    return int(C.LIQ_OUT_OF_MEMORY)
+  case ErrAborted:
+    return int(C.LIQ_ABORTED)
+  case ErrBitmapNotAvailable:
+    return int(C.LIQ_BITMAP_NOT_AVAILABLE)
+  case ErrBufferTooSmall:
+    return int(C.LIQ_BUFFER_TOO_SMALL)
+  case ErrInvalidPointer:
+    return int(C.LIQ_INVALID_POINTER)
+  case ErrUnsupported:
+    return int(C.LIQ_UNSUPPORTED)
+  default:
+    return -1
+  }
+}
@@ -0,0 +1,51 @@
+/*
+Package canvas provides helper functions for the animation canvas that are shared by the subpackages of imagequant.
+*/
+package canvas
+
+import (
+  "image"
+  "image/draw"
+)
+
+
+// Converts img into a canvas with origin (0, 0).
+func New(img image.Image) *image.NRGBA {
+  b := img.Bounds()
+  canvas := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+  draw.Draw(canvas, canvas.Bounds(), img, b.Min, draw.Src)
+  return canvas
+}
+
+// Returns a copy of the canvas.
+func Clone(canvas *image.NRGBA) *image.NRGBA {
+  retVal := image.NewNRGBA(canvas.Bounds())
+  copy(retVal.Pix, canvas.Pix)
+  return retVal
+}
+
+// Returns the bounding rectangle of all pixels of a and b for which match returns true. Both canvases must have
+// the same bounds. match is called with the four bytes of a pixel of a and b respectively.
+func DiffRect(a, b *image.NRGBA, match func(pa, pb []byte) bool) image.Rectangle {
+  var r image.Rectangle
+  bounds := a.Bounds()
+  for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+    for x := bounds.Min.X; x < bounds.Max.X; x++ {
+      ofs := a.PixOffset(x, y)
+      if match(a.Pix[ofs:ofs+4], b.Pix[ofs:ofs+4]) {
+        r = r.Union(image.Rect(x, y, x+1, y+1))
+      }
+    }
+  }
+  return r
+}
+
+// Match function for DiffRect. Returns whether both pixels differ.
+func Differs(pa, pb []byte) bool {
+  return pa[0] != pb[0] || pa[1] != pb[1] || pa[2] != pb[2] || pa[3] != pb[3]
+}
+
+// Returns the number of pixels covered by the rectangle.
+func Area(r image.Rectangle) int {
+  return r.Dx() * r.Dy()
+}
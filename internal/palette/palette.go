@@ -0,0 +1,63 @@
+/*
+Package palette provides helper functions for paletted images that are shared by the subpackages of imagequant.
+*/
+package palette
+
+import (
+  "image"
+  "image/color"
+)
+
+
+// Assigns the palette p to img. Palette indices of img are translated to the closest colors of p if the palette
+// of img differs from p. Exact color matches take precedence over closest colors.
+func Convert(img *image.Paletted, p color.Palette) {
+  lut := make([]byte, len(img.Palette))
+  identical := len(img.Palette) == len(p)
+  for i, c := range img.Palette {
+    lut[i] = byte(p.Index(c))
+    for j, c2 := range p {
+      if Equal(c, c2) {
+        lut[i] = byte(j)
+        break
+      }
+    }
+    identical = identical && int(lut[i]) == i
+  }
+  if !identical {
+    for i := range img.Pix { img.Pix[i] = lut[img.Pix[i]] }
+  }
+  img.Palette = p
+}
+
+// Returns whether both colors are identical after conversion to non-premultiplied 8-bit RGBA.
+func Equal(c1, c2 color.Color) bool {
+  return toNRGBA(c1) == toNRGBA(c2)
+}
+
+// Used internally. Converts c to non-premultiplied 8-bit RGBA. Colors that provide their non-premultiplied components,
+// such as imagequant.Color, are converted without the loss of precision caused by premultiplication.
+func toNRGBA(c color.Color) color.NRGBA {
+  if nc, ok := c.(interface{ NRGBA() color.NRGBA }); ok { return nc.NRGBA() }
+  return color.NRGBAModel.Convert(c).(color.NRGBA)
+}
+
+// Returns a copy of img with reordered palette entries. order[i] defines the index of the entry in the palette of img
+// that is stored at index i of the new palette. order must be a permutation of the palette indices.
+// Pixel indices are translated accordingly.
+func Permute(img *image.Paletted, order []int) *image.Paletted {
+  p := make(color.Palette, len(order))
+  lut := make([]byte, 256)
+  for i, j := range order {
+    p[i] = img.Palette[j]
+    lut[j] = byte(i)
+  }
+  retVal := image.NewPaletted(img.Rect, p)
+  for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+    sofs, dofs := img.PixOffset(img.Rect.Min.X, y), retVal.PixOffset(img.Rect.Min.X, y)
+    for x := 0; x < img.Rect.Dx(); x++ {
+      retVal.Pix[dofs+x] = lut[img.Pix[sofs+x]]
+    }
+  }
+  return retVal
+}
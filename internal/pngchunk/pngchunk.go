@@ -0,0 +1,181 @@
+/*
+Package pngchunk provides low-level functions for reading and writing the chunks and image data of PNG files.
+*/
+package pngchunk
+
+import (
+  "bytes"
+  "compress/zlib"
+  "encoding/binary"
+  "errors"
+  "hash/crc32"
+  "image/color"
+  "io"
+)
+
+
+// Signature is the byte sequence at the start of every PNG file.
+const Signature = "\x89PNG\r\n\x1a\n"
+
+var (
+  ErrSignature  = errors.New("Not a PNG file")
+  ErrChecksum   = errors.New("Invalid chunk checksum")
+  ErrFormat     = errors.New("Invalid image data")
+)
+
+// Filter types of scanlines.
+const (
+  FilterNone    = 0
+  FilterSub     = 1
+  FilterUp      = 2
+  FilterAverage = 3
+  FilterPaeth   = 4
+)
+
+
+// Writes the PNG signature to w.
+func WriteSignature(w io.Writer) error {
+  _, err := io.WriteString(w, Signature)
+  return err
+}
+
+// Reads the PNG signature from r. Returns ErrSignature if r does not start with a PNG signature.
+func ReadSignature(r io.Reader) error {
+  var buf [len(Signature)]byte
+  if _, err := io.ReadFull(r, buf[:]); err != nil { return err }
+  if string(buf[:]) != Signature { return ErrSignature }
+  return nil
+}
+
+// Writes a chunk of the given type to w. The length and checksum of the chunk are calculated from data.
+func WriteChunk(w io.Writer, chunkType string, data []byte) error {
+  var header [8]byte
+  binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+  copy(header[4:], chunkType)
+  crc := crc32.NewIEEE()
+  crc.Write(header[4:])
+  crc.Write(data)
+  var footer [4]byte
+  binary.BigEndian.PutUint32(footer[:], crc.Sum32())
+
+  if _, err := w.Write(header[:]); err != nil { return err }
+  if _, err := w.Write(data); err != nil { return err }
+  _, err := w.Write(footer[:])
+  return err
+}
+
+// Reads the next chunk from r and returns its type and data. Returns ErrChecksum if the checksum of the chunk does not match.
+func ReadChunk(r io.Reader) (chunkType string, data []byte, err error) {
+  var header [8]byte
+  if _, err = io.ReadFull(r, header[:]); err != nil { return }
+  length := binary.BigEndian.Uint32(header[:4])
+  if length > 0x7fffffff { err = ErrFormat; return }
+  data = make([]byte, length)
+  if _, err = io.ReadFull(r, data); err != nil { return }
+  var footer [4]byte
+  if _, err = io.ReadFull(r, footer[:]); err != nil { return }
+  crc := crc32.NewIEEE()
+  crc.Write(header[4:])
+  crc.Write(data)
+  if crc.Sum32() != binary.BigEndian.Uint32(footer[:]) { err = ErrChecksum; return }
+  chunkType = string(header[4:])
+  return
+}
+
+
+// Filters and compresses the scanlines of an image. pix contains height rows of stride bytes, of which the first
+// rowSize bytes are used. Each scanline is stored with filter type FilterNone.
+func Compress(pix []byte, rowSize, stride, height int, level int) ([]byte, error) {
+  var buf bytes.Buffer
+  zw, err := zlib.NewWriterLevel(&buf, level)
+  if err != nil { return nil, err }
+  filter := []byte{ FilterNone }
+  for y := 0; y < height; y++ {
+    if _, err = zw.Write(filter); err != nil { return nil, err }
+    if _, err = zw.Write(pix[y*stride:y*stride+rowSize]); err != nil { return nil, err }
+  }
+  if err = zw.Close(); err != nil { return nil, err }
+  return buf.Bytes(), nil
+}
+
+// Decompresses and unfilters the scanlines of an image with height rows of rowSize bytes each.
+// bpp defines the number of bytes per complete pixel, rounded up to one. Returns the rows without filter bytes.
+func Decompress(data []byte, rowSize, height, bpp int) ([]byte, error) {
+  zr, err := zlib.NewReader(bytes.NewReader(data))
+  if err != nil { return nil, err }
+  defer zr.Close()
+  // the buffer grows with the decompressed data instead of being allocated up front, so that the image size of
+  // a crafted header can't cause huge allocations
+  size := (rowSize + 1) * height
+  raw, err := io.ReadAll(io.LimitReader(zr, int64(size)))
+  if err != nil { return nil, err }
+  if len(raw) < size { return nil, io.ErrUnexpectedEOF }
+
+  pix := make([]byte, rowSize * height)
+  prev := make([]byte, rowSize)
+  for y := 0; y < height; y++ {
+    line := raw[y*(rowSize+1):(y+1)*(rowSize+1)]
+    cur := pix[y*rowSize:(y+1)*rowSize]
+    copy(cur, line[1:])
+    if err = unfilter(line[0], cur, prev, bpp); err != nil { return nil, err }
+    prev = cur
+  }
+  return pix, nil
+}
+
+// Returns the content of the PLTE and tRNS chunks for the palette p. The tRNS chunk is truncated after the last
+// translucent entry and is empty if all colors are opaque.
+func EncodePalette(p color.Palette) (plte, trns []byte) {
+  plte = make([]byte, 0, 3 * len(p))
+  trns = make([]byte, 0, len(p))
+  last := -1
+  for i, c := range p {
+    nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+    plte = append(plte, nc.R, nc.G, nc.B)
+    trns = append(trns, nc.A)
+    if nc.A != 0xff { last = i }
+  }
+  return plte, trns[:last+1]
+}
+
+
+// Used internally. Reverses the filter of a single scanline in place. prev contains the unfiltered previous scanline.
+func unfilter(filter byte, cur, prev []byte, bpp int) error {
+  switch filter {
+  case FilterNone:
+  case FilterSub:
+    for i := bpp; i < len(cur); i++ { cur[i] += cur[i-bpp] }
+  case FilterUp:
+    for i := range cur { cur[i] += prev[i] }
+  case FilterAverage:
+    for i := range cur {
+      var left int
+      if i >= bpp { left = int(cur[i-bpp]) }
+      cur[i] += byte((left + int(prev[i])) / 2)
+    }
+  case FilterPaeth:
+    for i := range cur {
+      var a, c int
+      if i >= bpp { a, c = int(cur[i-bpp]), int(prev[i-bpp]) }
+      cur[i] += paeth(a, int(prev[i]), c)
+    }
+  default:
+    return ErrFormat
+  }
+  return nil
+}
+
+// Used internally. Implements the Paeth predictor.
+func paeth(a, b, c int) byte {
+  p := a + b - c
+  pa, pb, pc := abs(p - a), abs(p - b), abs(p - c)
+  if pa <= pb && pa <= pc { return byte(a) }
+  if pb <= pc { return byte(b) }
+  return byte(c)
+}
+
+// Used internally. Returns the absolute value of x.
+func abs(x int) int {
+  if x < 0 { return -x }
+  return x
+}
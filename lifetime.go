@@ -0,0 +1,130 @@
+package imagequant
+// Synchronization of object usage and release.
+
+import (
+  "sync"
+)
+
+
+// Used internally. Synchronizes the use of a C object with its release.
+//
+// Functions using the C object hold a shared lock for the duration of the call. Functions modifying the object hold
+// an exclusive lock. Closing the object acquires an exclusive lock as well and therefore waits for pending calls to
+// complete. Afterwards the object is no longer available and functions fail with ErrInvalidPointer.
+//
+// Functions involving multiple objects acquire locks in the order Attributes, Histogram, Image, background Image, Result.
+// Since the roles of foreground and background are interchangeable, SetImageBackground uses acquireExclusivePair
+// instead, and background images never form a cycle.
+type guard struct {
+  mu    sync.RWMutex
+  open  bool    // set by constructors when the C object is available
+}
+
+
+// Used internally. Acquires shared access to the object. Returns false if the object is not available.
+func (g *guard) acquire() bool {
+  g.mu.RLock()
+  if !g.open {
+    g.mu.RUnlock()
+    return false
+  }
+  return true
+}
+
+// Used internally. Releases shared access to the object.
+func (g *guard) release() {
+  g.mu.RUnlock()
+}
+
+// Used internally. Acquires exclusive access to the object. Returns false if the object is not available.
+func (g *guard) acquireExclusive() bool {
+  g.mu.Lock()
+  if !g.open {
+    g.mu.Unlock()
+    return false
+  }
+  return true
+}
+
+// Used internally. Releases exclusive access to the object.
+func (g *guard) releaseExclusive() {
+  g.mu.Unlock()
+}
+
+// Used internally. Acquires exclusive access to both objects. Unlike acquireAll it never waits for one object while
+// holding the other, so that it can't deadlock with calls that acquire the objects in the opposite order.
+// Returns false without holding any locks if one of the objects is not available.
+func acquireExclusivePair(g1, g2 *guard) bool {
+  for {
+    if !g1.acquireExclusive() { return false }
+    if g2.mu.TryLock() {
+      if g2.open { return true }
+      g2.mu.Unlock()
+      g1.releaseExclusive()
+      return false
+    }
+    // wait for the other object without holding any locks
+    g1.releaseExclusive()
+    g1, g2 = g2, g1
+  }
+}
+
+// Used internally. Marks the object as unavailable and calls free while holding exclusive access.
+// Does nothing if the object has already been closed.
+func (g *guard) close(free func()) {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  if g.open {
+    g.open = false
+    free()
+  }
+}
+
+
+// Used internally. Implemented by all objects that are protected by a guard.
+type guarded interface {
+  acquire() bool
+  release()
+}
+
+// Used internally. Implemented by all objects that support exclusive access.
+type exclusiveGuarded interface {
+  acquireExclusive() bool
+  releaseExclusive()
+}
+
+// Used internally. Wraps an object, so that acquireAll and releaseAll acquire and release exclusive access to it.
+type exclusive struct {
+  obj exclusiveGuarded
+}
+
+// Used internally. Acquires exclusive access to the wrapped object.
+func (e exclusive) acquire() bool {
+  return e.obj.acquireExclusive()
+}
+
+// Used internally. Releases exclusive access to the wrapped object.
+func (e exclusive) release() {
+  e.obj.releaseExclusive()
+}
+
+
+// Used internally. Acquires access to all given objects in the given order. Access is shared unless the object is 
+// wrapped by exclusive.
+// Returns false without holding any locks if one of the objects is not available.
+func acquireAll(objects ...guarded) bool {
+  for i, obj := range objects {
+    if !obj.acquire() {
+      releaseAll(objects[:i]...)
+      return false
+    }
+  }
+  return true
+}
+
+// Used internally. Releases access to all given objects in reverse order.
+func releaseAll(objects ...guarded) {
+  for i := len(objects) - 1; i >= 0; i-- {
+    objects[i].release()
+  }
+}
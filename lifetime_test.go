@@ -0,0 +1,217 @@
+package imagequant
+
+import (
+  "errors"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+
+// Used internally. Objects used by the lifetime tests.
+type lifetimeObjects struct {
+  att   *Attributes
+  img   *Image
+  hist  *Histogram
+  res   *Result
+}
+
+// Used internally. Creates all objects. The progress callbacks of att and res call progress.
+func newLifetimeObjects(t *testing.T, progress ProgressCallback) *lifetimeObjects {
+  t.Helper()
+  o := &lifetimeObjects{ att: CreateAttributes() }
+  var err error
+  if o.img, err = o.att.NewImage(gradientImage(32, 32), 0); err != nil { t.Fatal(err) }
+  if o.res, err = o.att.QuantizeImage(o.img); err != nil { t.Fatal(err) }
+  if o.hist, err = o.att.NewHistogram(); err != nil { t.Fatal(err) }
+  if err = o.att.AddImageToHistogram(o.hist, o.img); err != nil { t.Fatal(err) }
+  o.att.SetProgressCallback(progress)
+  o.att.SetResultProgressCallback(o.res, progress)
+  return o
+}
+
+// Used internally. Releases all objects.
+func (o *lifetimeObjects) close() {
+  o.res.Close()
+  o.hist.Close()
+  o.img.Close()
+  o.att.Close()
+}
+
+// Used internally. Checks whether err is nil or wraps ErrInvalidPointer.
+func checkLifetimeError(t *testing.T, name string, err error) {
+  t.Helper()
+  if err == nil { return }
+  var qerr *Error
+  if !errors.Is(err, ErrInvalidPointer) || !errors.As(err, &qerr) { t.Errorf("%s: got %v, want nil or ErrInvalidPointer", name, err) }
+}
+
+
+var lifetimeTests = []struct {
+  name    string
+  call    func(o *lifetimeObjects) error  // function that is still in progress when the object is closed
+  close   func(o *lifetimeObjects)        // closes the object used by call
+  after   func(o *lifetimeObjects) error  // function that must fail after close
+}{
+  {
+    "Attributes",
+    func(o *lifetimeObjects) error { res, err := o.att.QuantizeImage(o.img); res.Close(); return err },
+    func(o *lifetimeObjects) { o.att.Close() },
+    func(o *lifetimeObjects) error { return o.att.SetSpeed(5) },
+  },
+  {
+    "Image",
+    func(o *lifetimeObjects) error { res, err := o.att.QuantizeImage(o.img); res.Close(); return err },
+    func(o *lifetimeObjects) { o.img.Close() },
+    func(o *lifetimeObjects) error { _, err := o.att.WriteRemappedImage(o.res, o.img); return err },
+  },
+  {
+    "Histogram",
+    func(o *lifetimeObjects) error { res, err := o.att.QuantizeHistogram(o.hist); res.Close(); return err },
+    func(o *lifetimeObjects) { o.hist.Close() },
+    func(o *lifetimeObjects) error { _, err := o.att.QuantizeHistogram(o.hist); return err },
+  },
+  {
+    "Result",
+    func(o *lifetimeObjects) error { _, err := o.att.WriteRemappedImage(o.res, o.img); return err },
+    func(o *lifetimeObjects) { o.res.Close() },
+    func(o *lifetimeObjects) error { return o.att.SetDitheringLevel(o.res, 0.5) },
+  },
+}
+
+func TestCloseDuringCall(t *testing.T) {
+  for _, tt := range lifetimeTests {
+    tt := tt
+    t.Run(tt.name, func(t *testing.T) {
+      // the first progress report starts closing the object and gives Close time to complete prematurely
+      started := make(chan struct{})
+      closed := make(chan struct{})
+      var closeDone atomic.Bool
+      var once sync.Once
+      o := newLifetimeObjects(t, func(percent float32) bool {
+        once.Do(func() {
+          close(started)
+          time.Sleep(20 * time.Millisecond)
+          if closeDone.Load() { t.Error("object closed while it was in use") }
+        })
+        return true
+      })
+      defer o.close()
+
+      go func() {
+        <-started
+        tt.close(o)
+        closeDone.Store(true)
+        close(closed)
+      }()
+      if err := tt.call(o); err != nil { t.Fatal(err) }
+      <-closed
+      if err := tt.after(o); !errors.Is(err, ErrInvalidPointer) { t.Errorf("got %v, want ErrInvalidPointer", err) }
+    })
+  }
+}
+
+func TestCloseConcurrent(t *testing.T) {
+  for _, tt := range lifetimeTests {
+    for n := 0; n < 20; n++ {
+      o := newLifetimeObjects(t, nil)
+      var wg sync.WaitGroup
+      for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+          defer wg.Done()
+          checkLifetimeError(t, tt.name, tt.call(o))
+          checkLifetimeError(t, tt.name, tt.after(o))
+        }()
+      }
+      wg.Add(1)
+      go func() {
+        defer wg.Done()
+        tt.close(o)
+      }()
+      wg.Wait()
+      o.close()
+    }
+  }
+}
+
+func TestCloseTwice(t *testing.T) {
+  o := newLifetimeObjects(t, nil)
+  for i := 0; i < 2; i++ {
+    for _, err := range []error{ o.res.Close(), o.hist.Close(), o.img.Close(), o.att.Close() } {
+      if err != nil { t.Fatal(err) }
+    }
+  }
+  for _, tt := range lifetimeTests {
+    if err := tt.after(o); !errors.Is(err, ErrInvalidPointer) { t.Errorf("%s: got %v, want ErrInvalidPointer", tt.name, err) }
+  }
+  if att := o.att.CopyAttribute(); att != nil { t.Error("copy of closed object") }
+  if v := o.att.GetSpeed(); v != -1 { t.Errorf("got speed %d of closed object", v) }
+}
+
+func TestSetImageBackgroundConcurrent(t *testing.T) {
+  att := CreateAttributes()
+  defer att.Release()
+  images := make([]*Image, 3)
+  for i := range images {
+    var err error
+    if images[i], err = att.NewImage(gradientImage(16, 16), 0); err != nil { t.Fatal(err) }
+    defer images[i].Close()
+  }
+  res, err := att.QuantizeImage(images[0])
+  if err != nil { t.Fatal(err) }
+  defer res.Close()
+
+  // swapped roles and remapping must neither deadlock nor create a cycle of background images
+  done := make(chan struct{})
+  go func() {
+    defer close(done)
+    var wg sync.WaitGroup
+    for i := 0; i < 6; i++ {
+      i := i
+      wg.Add(1)
+      go func() {
+        defer wg.Done()
+        a, b := images[i % 3], images[(i + 1) % 3]
+        if i % 2 == 1 { a, b = b, a }
+        for n := 0; n < 200; n++ {
+          if err := att.SetImageBackground(a, b); err != nil && !errors.Is(err, ErrUnsupported) { t.Error(err); return }
+          if _, err := att.WriteRemappedImage(res, a); err != nil { t.Error(err); return }
+        }
+      }()
+    }
+    wg.Wait()
+  }()
+  select {
+  case <-done:
+  case <-time.After(time.Minute):
+    t.Fatal("deadlock")
+  }
+
+  for _, img := range images {
+    seen := 0
+    for b := img; b != nil && seen <= len(images); b = b.background { seen++ }
+    if seen > len(images) { t.Errorf("cycle of background images") }
+  }
+}
+
+func TestSetImageBackgroundCycle(t *testing.T) {
+  att := CreateAttributes()
+  defer att.Release()
+  images := make([]*Image, 3)
+  for i := range images {
+    var err error
+    if images[i], err = att.NewImage(gradientImage(16, 16), 0); err != nil { t.Fatal(err) }
+    defer images[i].Close()
+  }
+  if err := att.SetImageBackground(images[0], images[1]); err != nil { t.Fatal(err) }
+  if err := att.SetImageBackground(images[1], images[2]); err != nil { t.Fatal(err) }
+  for _, pair := range [][2]int{ { 1, 0 }, { 2, 0 }, { 2, 1 } } {
+    err := att.SetImageBackground(images[pair[0]], images[pair[1]])
+    if !errors.Is(err, ErrUnsupported) { t.Errorf("%v: got %v, want ErrUnsupported", pair, err) }
+  }
+  // replacing a background breaks the chain
+  if err := att.SetImageBackground(images[0], images[2]); err != nil { t.Fatal(err) }
+  if err := att.SetImageBackground(images[1], images[0]); err != nil { t.Errorf("got %v after removing cycle", err) }
+}
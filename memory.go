@@ -0,0 +1,204 @@
+package imagequant
+// Accounting of memory allocated by the library.
+//
+// Memory allocated by the library is invisible to Go's garbage collector. All Attributes objects are therefore created
+// with a custom allocator that keeps track of the number of bytes allocated on behalf of each Attributes object.
+// Allocations are charged to the memory account of the Attributes object that was used to call the library function.
+//
+// The account is bound to the thread that calls the library function. If the library has been built with OpenMP support,
+// allocations of its worker threads are not charged to any account and are not subject to the memory limit. They are
+// still included in MemoryStats.CBytes.
+
+/*
+#include <stdlib.h>
+#include <stdint.h>
+#include "libimagequant.h"
+
+// Allocation header size. Large enough to preserve the alignment guaranteed by malloc.
+#define LIQ_ALLOC_HEADER 16
+
+typedef struct liqAccount {
+  size_t refs;    // one reference for the owner plus one for each live allocation
+  size_t live;    // currently allocated bytes
+  size_t limit;   // maximum number of allocated bytes, 0 = unlimited
+} liqAccount;
+
+static size_t liqTotalLive = 0;
+static __thread liqAccount *liqCurrentAccount = NULL;
+
+static liqAccount *liqAccountCreate(size_t limit) {
+  liqAccount *acc = calloc(1, sizeof(liqAccount));
+  if (acc != NULL) {
+    acc->refs = 1;
+    acc->limit = limit;
+  }
+  return acc;
+}
+
+static void liqAccountRetain(liqAccount *acc) {
+  if (acc != NULL) {
+    __atomic_add_fetch(&acc->refs, 1, __ATOMIC_RELAXED);
+  }
+}
+
+static void liqAccountRelease(liqAccount *acc) {
+  if (acc != NULL && __atomic_sub_fetch(&acc->refs, 1, __ATOMIC_ACQ_REL) == 0) {
+    free(acc);
+  }
+}
+
+static size_t liqAccountLive(liqAccount *acc) {
+  return __atomic_load_n(&acc->live, __ATOMIC_RELAXED);
+}
+
+static size_t liqAccountLimit(liqAccount *acc) {
+  return __atomic_load_n(&acc->limit, __ATOMIC_RELAXED);
+}
+
+static void liqAccountSetLimit(liqAccount *acc, size_t limit) {
+  __atomic_store_n(&acc->limit, limit, __ATOMIC_RELAXED);
+}
+
+static size_t liqTotalAllocated(void) {
+  return __atomic_load_n(&liqTotalLive, __ATOMIC_RELAXED);
+}
+
+// Sets the account that is charged for allocations of the current thread. Returns the previous account.
+static liqAccount *liqAccountSwap(liqAccount *acc) {
+  liqAccount *prev = liqCurrentAccount;
+  liqCurrentAccount = acc;
+  return prev;
+}
+
+static void *liqAccountMalloc(size_t size) {
+  liqAccount *acc = liqCurrentAccount;
+  if (acc != NULL) {
+    size_t live = __atomic_load_n(&acc->live, __ATOMIC_RELAXED);
+    do {
+      size_t limit = __atomic_load_n(&acc->limit, __ATOMIC_RELAXED);
+      if (limit > 0 && (live + size > limit || live + size < live)) return NULL;
+    } while (!__atomic_compare_exchange_n(&acc->live, &live, live + size, 1, __ATOMIC_RELAXED, __ATOMIC_RELAXED));
+    liqAccountRetain(acc);
+  }
+
+  unsigned char *ptr = malloc(size + LIQ_ALLOC_HEADER);
+  if (ptr == NULL) {
+    if (acc != NULL) {
+      __atomic_sub_fetch(&acc->live, size, __ATOMIC_RELAXED);
+      liqAccountRelease(acc);
+    }
+    return NULL;
+  }
+  *(liqAccount**)ptr = acc;
+  *(size_t*)(ptr + sizeof(liqAccount*)) = size;
+  __atomic_add_fetch(&liqTotalLive, size, __ATOMIC_RELAXED);
+  return ptr + LIQ_ALLOC_HEADER;
+}
+
+static void liqAccountFree(void *p) {
+  if (p == NULL) return;
+  unsigned char *ptr = (unsigned char*)p - LIQ_ALLOC_HEADER;
+  liqAccount *acc = *(liqAccount**)ptr;
+  size_t size = *(size_t*)(ptr + sizeof(liqAccount*));
+  __atomic_sub_fetch(&liqTotalLive, size, __ATOMIC_RELAXED);
+  if (acc != NULL) {
+    __atomic_sub_fetch(&acc->live, size, __ATOMIC_RELAXED);
+    liqAccountRelease(acc);
+  }
+  free(ptr);
+}
+
+static liq_attr *liqAttrCreate(void) {
+  return liq_attr_create_with_allocator(liqAccountMalloc, liqAccountFree);
+}
+*/
+import "C"
+
+import (
+  "runtime"
+  "sync/atomic"
+)
+
+
+// MemoryStats contains statistics about objects and memory managed by the library.
+type MemoryStats struct {
+  Attributes  int64   // Number of Attributes objects that have not been released
+  Images      int64   // Number of Image objects that have not been released
+  Histograms  int64   // Number of Histogram objects that have not been released
+  Results     int64   // Number of Result objects that have not been released
+  CBytes      int64   // Number of bytes allocated by the library outside of the Go heap
+}
+
+// Used internally. Number of objects that have not been released.
+var liveAttributes, liveImages, liveHistograms, liveResults atomic.Int64
+
+
+// Returns statistics about objects and memory currently managed by the library.
+//
+// CBytes covers allocations made on behalf of all Attributes objects and the objects created with their help.
+func Stats() MemoryStats {
+  return MemoryStats{
+    Attributes: liveAttributes.Load(),
+    Images:     liveImages.Load(),
+    Histograms: liveHistograms.Load(),
+    Results:    liveResults.Load(),
+    CBytes:     int64(C.liqTotalAllocated()),
+  }
+}
+
+
+// Used internally. Refers to the memory account of an Attributes object.
+//
+// The account remains valid until the owner and all allocations charged to it have released their references.
+type memoryAccount struct {
+  acc *C.liqAccount
+}
+
+// Used internally. Creates a new memory account with the given limit in bytes (0 = unlimited).
+func newMemoryAccount(limit int64) (memoryAccount, bool) {
+  acc := C.liqAccountCreate(C.size_t(limit))
+  return memoryAccount{ acc }, acc != nil
+}
+
+// Used internally. Adds a reference to the account. It must be released by release.
+func (a memoryAccount) retain() memoryAccount {
+  C.liqAccountRetain(a.acc)
+  return a
+}
+
+// Used internally. Releases a reference to the account.
+func (a memoryAccount) release() {
+  C.liqAccountRelease(a.acc)
+}
+
+// Used internally. Returns the number of bytes currently charged to the account.
+func (a memoryAccount) usage() int64 {
+  if a.acc == nil { return 0 }
+  return int64(C.liqAccountLive(a.acc))
+}
+
+// Used internally. Returns the allocation limit of the account in bytes.
+func (a memoryAccount) limit() int64 {
+  if a.acc == nil { return 0 }
+  return int64(C.liqAccountLimit(a.acc))
+}
+
+// Used internally. Sets the allocation limit of the account in bytes.
+func (a memoryAccount) setLimit(limit int64) {
+  if a.acc != nil { C.liqAccountSetLimit(a.acc, C.size_t(limit)) }
+}
+
+// Used internally. Calls f while library allocations of the current thread are charged to the account.
+func (a memoryAccount) run(f func()) {
+  runtime.LockOSThread()
+  defer runtime.UnlockOSThread()
+  prev := C.liqAccountSwap(a.acc)
+  defer C.liqAccountSwap(prev)
+  f()
+}
+
+// Used internally. Creates a library attributes structure that uses the accounting allocator.
+func (a memoryAccount) createAttr() (attr *C.struct_liq_attr) {
+  a.run(func() { attr = C.liqAttrCreate() })
+  return
+}
@@ -2,65 +2,230 @@ package imagequant
 // Collection of miscellaneous functions.
 
 import (
+  "encoding/binary"
   "image"
   "image/color"
+  "sync"
 )
 
 // NRGBA converts a premultiplied color back to a normalized color with each component in range [0, 255].
+//
+// Color components are un-premultiplied at full 16-bit precision before they are reduced to 8 bits.
 func NRGBA(col color.Color) (r, g, b, a byte) {
-  if nrgba, ok := col.(color.NRGBA); ok {
-    r, g, b, a = nrgba.R, nrgba.G, nrgba.B, nrgba.A
-  } else {
-    pr, pg, pb, pa := col.RGBA()
-    pa >>= 8
-    if pa > 0 {
-      pr >>= 8
-      pr *= 0xff
-      pr /= pa
-      pg >>= 8
-      pg *= 0xff
-      pg /= pa
-      pb >>= 8
-      pb *= 0xff
-      pb /= pa
+  if c, ok := col.(Color); ok { return c.R, c.G, c.B, c.A }
+  c := color.NRGBAModel.Convert(col).(color.NRGBA)
+  return c.R, c.G, c.B, c.A
+}
+
+// Color is a non-premultiplied 8-bit RGBA color in the format used by the library.
+//
+// It implements the color.Color interface and can be passed to all functions expecting a color.Color argument 
+// without any loss of precision.
+type Color struct {
+  R, G, B, A uint8
+}
+
+// RGBA implements the color.Color interface.
+func (c Color) RGBA() (r, g, b, a uint32) {
+  return color.NRGBA{ c.R, c.G, c.B, c.A }.RGBA()
+}
+
+// NRGBA returns the color as color.NRGBA. Unlike color.NRGBAModel, the conversion is free of rounding errors for
+// translucent colors.
+func (c Color) NRGBA() color.NRGBA {
+  return color.NRGBA{ c.R, c.G, c.B, c.A }
+}
+
+// ColorModel converts arbitrary colors to the Color type.
+var ColorModel color.Model = color.ModelFunc(colorModel)
+
+func colorModel(c color.Color) color.Color {
+  if _, ok := c.(Color); ok { return c }
+  r, g, b, a := NRGBA(c)
+  return Color{ r, g, b, a }
+}
+
+// toColor converts an arbitrary color into a non-premultiplied 8-bit color.
+func toColor(c color.Color) Color {
+  return colorModel(c).(Color)
+}
+
+// imageToBytes32 converts the given image into a 32-bit byte array of non-premultiplied RGBA pixels.
+//
+// Common image types are converted directly from their pixel buffers. *image.NRGBA images are not converted, see nrgbaRows.
+func imageToBytes32(img image.Image) []byte {
+  switch src := img.(type) {
+  case *image.RGBA:
+    return rgbaToBytes32(src)
+  case *image.NRGBA64:
+    return nrgba64ToBytes32(src)
+  case *image.Gray:
+    return grayToBytes32(src)
+  case *image.YCbCr:
+    return ycbcrToBytes32(src)
+  case *image.Paletted:
+    return palettedToBytes32(src)
+  }
+
+  b := img.Bounds()
+  retVal := make([]byte, b.Dx()*b.Dy()*4)
+  dofs := 0
+  for y := b.Min.Y; y < b.Max.Y; y++ {
+    for x := b.Min.X; x < b.Max.X; x++ {
+      retVal[dofs], retVal[dofs+1], retVal[dofs+2], retVal[dofs+3] = NRGBA(img.At(x, y))
+      dofs += 4
     }
-    r = byte(pr)
-    g = byte(pg)
-    b = byte(pb)
-    a = byte(pa)
   }
-  return
+  return retVal
 }
 
-// imageToBytes32 converts the given image into a 32-bit byte array.
-func imageToBytes32(img image.Image) []byte {
-  w := img.Bounds().Dx()
-  h := img.Bounds().Dy()
+// nrgbaRows returns the pixel rows of the given image without copying pixel data.
+func nrgbaRows(src *image.NRGBA) [][]byte {
+  w, h := src.Rect.Dx(), src.Rect.Dy()
+  retVal := make([][]byte, h)
+  for y := 0; y < h; y++ {
+    sofs := src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y + y)
+    retVal[y] = src.Pix[sofs:sofs+w*4:sofs+w*4]
+  }
+  return retVal
+}
+
+// rgbaToBytes32 un-premultiplies the pixels of the given image.
+//
+// Two pixels are examined at once, so that runs of fully opaque or fully transparent pixels are processed without
+// converting individual components. Other pixels are looked up in unpremultiplyTable.
+func rgbaToBytes32(src *image.RGBA) []byte {
+  const alphaMask = 0xff000000ff000000
+  table := unpremultiplyTable()
+  w, h := src.Rect.Dx(), src.Rect.Dy()
   retVal := make([]byte, w*h*4)
-  dofs := 0
   for y := 0; y < h; y++ {
-    for x := 0; x < w; x++ {
-      r, g, b, a := img.At(x, y).RGBA()
-      retVal[dofs] = byte(r >> 8)
-      retVal[dofs+1] = byte(g >> 8)
-      retVal[dofs+2] = byte(b >> 8)
-      retVal[dofs+3] = byte(a >> 8)
+    sofs := src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y + y)
+    s := src.Pix[sofs:sofs+w*4]
+    d := retVal[y*w*4:(y+1)*w*4]
+    i := 0
+    for ; i+8 <= len(s) && i+8 <= len(d); i += 8 {
+      v := binary.LittleEndian.Uint64(s[i:])
+      switch v & alphaMask {
+      case 0:
+        // fully transparent pixels are left black
+      case alphaMask:
+        binary.LittleEndian.PutUint64(d[i:], v)
+      default:
+        unpremultiplyPixel(table, d[i:i+4], s[i:i+4])
+        unpremultiplyPixel(table, d[i+4:i+8], s[i+4:i+8])
+      }
+    }
+    if i+4 <= len(s) && i+4 <= len(d) { unpremultiplyPixel(table, d[i:i+4], s[i:i+4]) }
+  }
+  return retVal
+}
+
+// unpremultiplyPixel converts the premultiplied pixel s to the non-premultiplied pixel d.
+func unpremultiplyPixel(table *[256*256]byte, d, s []byte) {
+  a := s[3]
+  row := table[int(a)<<8:int(a)<<8+256]
+  d[0], d[1], d[2], d[3] = row[s[0]], row[s[1]], row[s[2]], a
+}
+
+// unpremultiplyTable returns the results of unpremultiply for all combinations of alpha (high byte of the index) and
+// color component (low byte of the index). Entries for alpha 0 are 0.
+var unpremultiplyTable = sync.OnceValue(func() *[256*256]byte {
+  table := new([256*256]byte)
+  for a := 1; a < 256; a++ {
+    for c := 0; c < 256; c++ {
+      table[a<<8|c] = unpremultiply(byte(c), byte(a))
+    }
+  }
+  return table
+})
+
+// nrgba64ToBytes32 reduces the pixels of the given image to 8 bits per component.
+func nrgba64ToBytes32(src *image.NRGBA64) []byte {
+  w, h := src.Rect.Dx(), src.Rect.Dy()
+  retVal := make([]byte, w*h*4)
+  for y := 0; y < h; y++ {
+    sofs := src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y + y)
+    s := src.Pix[sofs:sofs+w*8]
+    d := retVal[y*w*4:(y+1)*w*4]
+    for i, j := 0, 0; i+7 < len(s) && j+3 < len(d); i, j = i+8, j+4 {
+      // most significant byte of each big-endian component
+      d[j], d[j+1], d[j+2], d[j+3] = s[i], s[i+2], s[i+4], s[i+6]
+    }
+  }
+  return retVal
+}
+
+// grayToBytes32 expands the pixels of the given grayscale image.
+func grayToBytes32(src *image.Gray) []byte {
+  w, h := src.Rect.Dx(), src.Rect.Dy()
+  retVal := make([]byte, w*h*4)
+  for y := 0; y < h; y++ {
+    sofs := src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y + y)
+    s := src.Pix[sofs:sofs+w]
+    d := retVal[y*w*4:(y+1)*w*4]
+    for i, j := 0, 0; i < len(s) && j+3 < len(d); i, j = i+1, j+4 {
+      d[j], d[j+1], d[j+2], d[j+3] = s[i], s[i], s[i], 0xff
+    }
+  }
+  return retVal
+}
+
+// ycbcrToBytes32 converts the pixels of the given YCbCr image to RGB.
+func ycbcrToBytes32(src *image.YCbCr) []byte {
+  w, h := src.Rect.Dx(), src.Rect.Dy()
+  retVal := make([]byte, w*h*4)
+  dofs := 0
+  for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+    for x := src.Rect.Min.X; x < src.Rect.Max.X; x++ {
+      yi, ci := src.YOffset(x, y), src.COffset(x, y)
+      r, g, b := color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+      retVal[dofs], retVal[dofs+1], retVal[dofs+2], retVal[dofs+3] = r, g, b, 0xff
       dofs += 4
     }
   }
   return retVal
 }
 
-// bytesToPaletted creates a image.Paletted object out of the given palette and pixel data.
-func bytesToPaletted(width, height int, palette color.Palette, pixels []byte) *image.Paletted {
-  retVal := image.NewPaletted(image.Rect(0, 0, width, height), palette)
-  y0, y1 := retVal.Bounds().Min.Y, retVal.Bounds().Max.Y
+// palettedToBytes32 resolves the palette indices of the given image.
+func palettedToBytes32(src *image.Paletted) []byte {
+  // palette indices without a matching palette entry resolve to transparent black
+  var lut [256][4]byte
+  for i := 0; i < len(src.Palette) && i < len(lut); i++ {
+    lut[i][0], lut[i][1], lut[i][2], lut[i][3] = NRGBA(src.Palette[i])
+  }
+
+  w, h := src.Rect.Dx(), src.Rect.Dy()
+  retVal := make([]byte, w*h*4)
+  for y := 0; y < h; y++ {
+    sofs := src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y + y)
+    s := src.Pix[sofs:sofs+w]
+    d := retVal[y*w*4:(y+1)*w*4]
+    for i, j := 0, 0; i < len(s) && j+3 < len(d); i, j = i+1, j+4 {
+      c := &lut[s[i]]
+      d[j], d[j+1], d[j+2], d[j+3] = c[0], c[1], c[2], c[3]
+    }
+  }
+  return retVal
+}
+
+// unpremultiply converts a premultiplied 8-bit color component to a non-premultiplied component.
+// Results are identical to color.NRGBAModel.
+func unpremultiply(c, a byte) byte {
+  v := (uint32(c) * 0xffff / uint32(a)) >> 8
+  if v > 0xff { v = 0xff }
+  return byte(v)
+}
+
+// bytesToPaletted creates a image.Paletted object covering the given rectangle out of the given palette and pixel data.
+func bytesToPaletted(rect image.Rectangle, palette color.Palette, pixels []byte) *image.Paletted {
+  retVal := image.NewPaletted(rect, palette)
+  width := rect.Dx()
   sofs := 0
-  dofs := y0 * retVal.Stride
-  for y := y0; y < y1; y++ {
-    copy(retVal.Pix[dofs:dofs+retVal.Stride], pixels[sofs:sofs+width])
+  for y := rect.Min.Y; y < rect.Max.Y; y++ {
+    dofs := retVal.PixOffset(rect.Min.X, y)
+    copy(retVal.Pix[dofs:dofs+width], pixels[sofs:sofs+width])
     sofs += width
-    dofs += retVal.Stride
   }
   return retVal
 }
@@ -0,0 +1,199 @@
+package imagequant
+
+import (
+  "errors"
+  "image"
+  "image/color"
+  "testing"
+
+  "github.com/InfinityTools/go-imagequant/internal/palette"
+)
+
+
+// Used internally. Returns a w x h image with a gradient of opaque colors.
+func gradientImage(w, h int) *image.NRGBA {
+  img := image.NewNRGBA(image.Rect(0, 0, w, h))
+  for y := 0; y < h; y++ {
+    for x := 0; x < w; x++ {
+      img.SetNRGBA(x, y, color.NRGBA{ uint8(x * 255 / w), uint8(y * 255 / h), 128, 255 })
+    }
+  }
+  return img
+}
+
+
+var colorTests = []struct {
+  name  string
+  c     color.Color
+  want  Color
+}{
+  { "RGBA", color.RGBA{ 100, 50, 0, 128 }, Color{ 199, 99, 0, 128 } },
+  { "NRGBA", color.NRGBA{ 200, 100, 0, 128 }, Color{ 200, 100, 0, 128 } },
+  { "RGBA64", color.RGBA64{ 0x6464, 0x3232, 0, 0x8080 }, Color{ 199, 99, 0, 128 } },
+  { "Gray", color.Gray{ 77 }, Color{ 77, 77, 77, 255 } },
+  { "YCbCr", color.YCbCr{ 100, 120, 140 }, Color{ 117, 94, 86, 255 } },
+  { "Color", Color{ 200, 100, 0, 128 }, Color{ 200, 100, 0, 128 } },
+}
+
+func TestToColor(t *testing.T) {
+  for _, tt := range colorTests {
+    if got := toColor(tt.c); got != tt.want { t.Errorf("%s: got %v, want %v", tt.name, got, tt.want) }
+  }
+}
+
+func TestAddImageFixedColor(t *testing.T) {
+  for _, tt := range colorTests {
+    att := CreateAttributes()
+    img, err := att.NewImage(gradientImage(8, 8), 0)
+    if err != nil { t.Fatal(err) }
+    if err = att.AddImageFixedColor(img, tt.c); err != nil { t.Fatalf("%s: %v", tt.name, err) }
+    res, err := att.QuantizeImage(img)
+    if err != nil { t.Fatalf("%s: %v", tt.name, err) }
+    if p := att.GetPalette(res); !containsNear(p, tt.want) { t.Errorf("%s: %v not in palette %v", tt.name, tt.want, p) }
+    res.Close()
+    img.Close()
+    att.Release()
+  }
+}
+
+func TestAddColorsToHistogram(t *testing.T) {
+  for _, tt := range colorTests {
+    att := CreateAttributes()
+    hist := att.CreateHistogram()
+    entries := []HistogramEntry{ { Color: tt.c, Count: 10 }, { Color: color.Gray{ 0 }, Count: 10 } }
+    if err := att.AddColorsToHistogram(hist, entries, 0); err != nil { t.Fatalf("%s: %v", tt.name, err) }
+    res, err := att.QuantizeHistogram(hist)
+    if err != nil { t.Fatalf("%s: %v", tt.name, err) }
+    if p := att.GetPalette(res); !containsNear(p, tt.want) { t.Errorf("%s: %v not in palette %v", tt.name, tt.want, p) }
+    res.Close()
+    hist.Close()
+    att.Release()
+  }
+}
+
+func TestAddColorsToHistogramEmpty(t *testing.T) {
+  att := CreateAttributes()
+  defer att.Release()
+  hist := att.CreateHistogram()
+  defer hist.Close()
+  for _, entries := range [][]HistogramEntry{ nil, {} } {
+    err := att.AddColorsToHistogram(hist, entries, 0)
+    var qerr *Error
+    if !errors.Is(err, ErrInvalidPointer) || !errors.As(err, &qerr) { t.Errorf("%v entries: got %v", entries, err) }
+  }
+}
+
+// Used internally. Returns the error of QuantizeShared for two images and the given weights.
+func sharedError(att *Attributes, weights []float32) error {
+  images := []image.Image{ gradientImage(4, 4), gradientImage(4, 4) }
+  _, err := att.QuantizeShared(images, &SharedOptions{ Weights: weights })
+  return err
+}
+
+func TestErrorValues(t *testing.T) {
+  att := CreateAttributes()
+  defer att.Release()
+  img, err := att.NewImage(gradientImage(4, 4), 0)
+  if err != nil { t.Fatal(err) }
+  defer img.Close()
+  tests := []struct {
+    name  string
+    err   error
+    want  error
+  }{
+    { "SetImageBackground", att.SetImageBackground(img, img), ErrUnsupported },
+    { "SetMemoryLimit", att.SetMemoryLimit(-1), ErrValueOutOfRange },
+    { "QuantizeShared", sharedError(att, []float32{ 1 }), ErrValueOutOfRange },
+    { "QuantizeShared", sharedError(att, []float32{ 1, 2 }), ErrValueOutOfRange },
+  }
+  for _, tt := range tests {
+    var qerr *Error
+    if !errors.Is(tt.err, tt.want) || !errors.As(tt.err, &qerr) { t.Errorf("%s: got %v, want *Error wrapping %v", tt.name, tt.err, tt.want); continue }
+    if qerr.Op != tt.name || qerr.Code != errorToCode(tt.want) { t.Errorf("%s: got operation %q, code %d", tt.name, qerr.Op, qerr.Code) }
+  }
+}
+
+func TestRGBAToBytes32(t *testing.T) {
+  // all valid combinations of premultiplied color and alpha, odd width to cover the last pixel of a row
+  src := image.NewRGBA(image.Rect(0, 0, 257, 256))
+  for y := 0; y < 256; y++ {
+    for x := 0; x < 257; x++ {
+      c := uint8(x % 256 * y / 255)
+      src.SetRGBA(x, y, color.RGBA{ c, uint8(y) - c, c / 2, uint8(y) })
+    }
+  }
+  for _, img := range []*image.RGBA{ src, src.SubImage(image.Rect(3, 1, 254, 255)).(*image.RGBA) } {
+    got := rgbaToBytes32(img)
+    b := img.Bounds()
+    ofs := 0
+    for y := b.Min.Y; y < b.Max.Y; y++ {
+      for x := b.Min.X; x < b.Max.X; x++ {
+        want := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+        if want.A == 0 { want = color.NRGBA{} }
+        if g := (color.NRGBA{ got[ofs], got[ofs+1], got[ofs+2], got[ofs+3] }); g != want {
+          t.Fatalf("pixel (%d, %d) of %v: got %v, want %v", x, y, b, g, want)
+        }
+        ofs += 4
+      }
+    }
+  }
+}
+
+// Used internally. Returns a YCbCr image with the given subsampling, cropped to an odd size at an odd offset.
+func ycbcrImage(ratio image.YCbCrSubsampleRatio) image.Image {
+  img := image.NewYCbCr(image.Rect(0, 0, 16, 12), ratio)
+  for i := range img.Y { img.Y[i] = uint8(i * 7) }
+  for i := range img.Cb { img.Cb[i], img.Cr[i] = uint8(i * 13), uint8(255 - i * 5) }
+  return img.SubImage(image.Rect(3, 1, 14, 10))
+}
+
+// Used internally. Returns a paletted image with indices beyond the end of the palette.
+func palettedImage() *image.Paletted {
+  p := color.Palette{ color.NRGBA{ 200, 100, 0, 128 }, color.RGBA{ 10, 20, 30, 40 }, color.Gray{ 77 } }
+  img := image.NewPaletted(image.Rect(-2, 5, 9, 12), p)
+  for i := range img.Pix { img.Pix[i] = uint8(i * 37) }
+  return img.SubImage(image.Rect(-1, 6, 8, 11)).(*image.Paletted)
+}
+
+var imageTests = []struct {
+  name  string
+  img   image.Image
+}{
+  { "YCbCr 4:2:0", ycbcrImage(image.YCbCrSubsampleRatio420) },
+  { "YCbCr 4:2:2", ycbcrImage(image.YCbCrSubsampleRatio422) },
+  { "YCbCr 4:4:0", ycbcrImage(image.YCbCrSubsampleRatio440) },
+  { "YCbCr 4:4:4", ycbcrImage(image.YCbCrSubsampleRatio444) },
+  { "Paletted", palettedImage() },
+}
+
+func TestImageToBytes32(t *testing.T) {
+  for _, tt := range imageTests {
+    got := imageToBytes32(tt.img)
+    b := tt.img.Bounds()
+    if len(got) != b.Dx() * b.Dy() * 4 { t.Fatalf("%s: got %d bytes for bounds %v", tt.name, len(got), b) }
+    ofs := 0
+    for y := b.Min.Y; y < b.Max.Y; y++ {
+      for x := b.Min.X; x < b.Max.X; x++ {
+        var want color.NRGBA
+        // image.Paletted.At panics for indices without a palette entry, which resolve to transparent black
+        if p, ok := tt.img.(*image.Paletted); !ok || int(p.ColorIndexAt(x, y)) < len(p.Palette) {
+          want.R, want.G, want.B, want.A = NRGBA(tt.img.At(x, y))
+        }
+        if g := (color.NRGBA{ got[ofs], got[ofs+1], got[ofs+2], got[ofs+3] }); g != want {
+          t.Fatalf("%s: pixel (%d, %d): got %v, want %v", tt.name, x, y, g, want)
+        }
+        ofs += 4
+      }
+    }
+  }
+}
+
+func TestEqualTranslucent(t *testing.T) {
+  // premultiplication loses precision for colors with low alpha
+  for a := 1; a < 256; a++ {
+    for c := 0; c < 256; c++ {
+      qc, nc := Color{ uint8(c), 0, 0, uint8(a) }, color.NRGBA{ uint8(c), 0, 0, uint8(a) }
+      if toColor(nc) != qc || !palette.Equal(qc, nc) { t.Fatalf("%v differs from %v", qc, nc) }
+    }
+  }
+}
@@ -0,0 +1,212 @@
+package imagequant
+// Remapping of images to user-supplied palettes and palette layouts.
+
+import (
+  "image"
+  "image/color"
+
+  "github.com/InfinityTools/go-imagequant/internal/palette"
+)
+
+
+// Remaps img to the given palette without generating any colors of its own, e.g. to map artwork onto an existing
+// game palette.
+//
+// The palette of the returned image contains the colors of pal in the same order, and the returned image has the same
+// bounds as img. The remapper of the library is used with the given dithering level (see SetDitheringLevel).
+// Settings of att, such as the speed, are applied to the remapping. att is not modified. All pixels of the returned
+// image refer to the first color of pal if pal contains only one distinct color. Pixels never refer to duplicate
+// colors of pal, they use the first occurrence of the color instead. Posterization settings of att are ignored,
+// since the colors of pal must not be altered.
+//
+// Returns ErrValueOutOfRange if pal is empty or contains more than 256 colors. Returns ErrInvalidPointer if pal
+// contains nil colors.
+func (att *Attributes) RemapToPalette(img image.Image, pal color.Palette, ditherLevel float32) (*image.Paletted, error) {
+  if img == nil { return nil, invalidPointer("RemapToPalette") }
+  if len(pal) == 0 || len(pal) > 256 { return nil, newError("RemapToPalette", ErrValueOutOfRange, "%d colors in palette", len(pal)) }
+  var fixed color.Palette
+  for i, c := range pal {
+    if c == nil { return nil, newError("RemapToPalette", ErrInvalidPointer, "palette index %d", i) }
+    if !containsEqual(fixed, c) { fixed = append(fixed, c) }
+  }
+  // the library requires at least two colors
+  if len(fixed) == 1 { return image.NewPaletted(img.Bounds(), append(color.Palette(nil), pal...)), nil }
+
+  att2, err := att.NewCopy()
+  if err != nil { return nil, err }
+  defer att2.Release()
+  if err = att2.SetMaxColors(len(fixed)); err != nil { return nil, err }
+  _, maxQuality := att2.GetQuality()
+  if err = att2.SetQuality(QUALITY_WORST, maxQuality); err != nil { return nil, err }
+  if err = att2.SetMinPosterization(0); err != nil { return nil, err }
+
+  // the distinct colors of the palette are reserved as fixed colors and fill all available palette entries, so that
+  // the library does not generate any colors of its own
+  qimg, err := att2.NewImage(img, 0.0)
+  if err != nil { return nil, err }
+  defer qimg.Close()
+  for _, c := range fixed {
+    if err = att2.AddImageFixedColor(qimg, c); err != nil { return nil, err }
+  }
+
+  res, err := att2.QuantizeImage(qimg)
+  if err != nil { return nil, err }
+  defer res.Close()
+  if err = att2.SetDitheringLevel(res, ditherLevel); err != nil { return nil, err }
+  imgOut, err := att2.WriteRemappedImage(res, qimg)
+  if err != nil { return nil, err }
+
+  // library palette may be sorted differently, and colors may be off by one because of the floating point
+  // conversion of the library. Convert maps duplicate colors to their first occurrence in pal.
+  retVal := imgOut.(*image.Paletted)
+  for _, c := range retVal.Palette {
+    if !containsNear(fixed, c) { return nil, newError("RemapToPalette", ErrUnknown, "color %v not in palette", c) }
+  }
+  palette.Convert(retVal, append(color.Palette(nil), pal...))
+  return retVal, nil
+}
+
+// Used internally. Returns whether p contains a color identical to c.
+func containsEqual(p color.Palette, c color.Color) bool {
+  for _, pc := range p {
+    if palette.Equal(pc, c) { return true }
+  }
+  return false
+}
+
+// Used internally. Returns whether p contains a color that differs from c by at most 1 in each component.
+func containsNear(p color.Palette, c color.Color) bool {
+  near := func(a, b uint8) bool { return int(a) - int(b) >= -1 && int(a) - int(b) <= 1 }
+  c1 := toColor(c)
+  for _, pc := range p {
+    c2 := toColor(pc)
+    if near(c1.R, c2.R) && near(c1.G, c2.G) && near(c1.B, c2.B) && near(c1.A, c2.A) { return true }
+  }
+  return false
+}
+
+
+// PaletteSlot pins a color to a specific palette index.
+type PaletteSlot struct {
+  Index int         // Palette index in range 0-255
+  Color color.Color // Color at the palette index
+}
+
+// PaletteLayout defines colors that must be located at specific palette indices, e.g. a transparent key color at
+// index 0 and a shadow color at index 1:
+//
+//   layout := PaletteLayout{ { 0, Color{ 0, 255, 0, 255 } }, { 1, Color{ 0, 0, 0, 255 } } }
+//
+// Use AddImagePaletteLayout to reserve the colors before quantization and WriteRemappedImageLayout or Apply to move
+// them to their indices. Unused indices below the highest slot index are filled with opaque black.
+type PaletteLayout []PaletteSlot
+
+
+// Reserves the colors of the layout in the output palette created from img, see AddImageFixedColor.
+// It must be called before the image is quantized.
+//
+// Returns ErrValueOutOfRange if the layout is invalid.
+func (att *Attributes) AddImagePaletteLayout(img *Image, layout PaletteLayout) error {
+  if err := layout.validate(); err != nil { return err }
+  for _, slot := range layout {
+    if err := att.AddImageFixedColor(img, slot.Color); err != nil { return err }
+  }
+  return nil
+}
+
+// Same as WriteRemappedImage, but moves the colors of the layout to their palette indices. See PaletteLayout.Apply.
+func (att *Attributes) WriteRemappedImageLayout(res *Result, img *Image, layout PaletteLayout) (*image.Paletted, error) {
+  if err := layout.validate(); err != nil { return nil, err }
+  imgOut, err := att.WriteRemappedImage(res, img)
+  if err != nil { return nil, err }
+  return layout.Apply(imgOut.(*image.Paletted))
+}
+
+// Returns a copy of img with the colors of the layout at their palette indices. Pixel indices are translated
+// accordingly, so that the colors of the image are unchanged.
+//
+// Palette entries matching the color of a slot are moved to the index of the slot. Exact matches take precedence.
+// Otherwise a palette entry that differs by at most 1 in each color component is used and replaced by the color of
+// the slot, since the library may round fixed colors (see AddImageFixedColor). The remaining palette entries fill
+// the free indices in their original order. If a slot index lies beyond the end of the palette, the entries in
+// between are set to opaque black and are not referenced by any pixel. Add slots for these indices to choose
+// different colors.
+//
+// Returns ErrValueOutOfRange if the layout is invalid, if the palette does not contain the color of a slot or if the
+// resulting palette contains more than 256 colors.
+func (layout PaletteLayout) Apply(img *image.Paletted) (*image.Paletted, error) {
+  if img == nil { return nil, invalidPointer("PaletteLayout.Apply") }
+  if err := layout.validate(); err != nil { return nil, err }
+
+  // source index of each slot, exact matches first
+  matched := make([]bool, len(img.Palette))
+  sources := make([]int, len(layout))
+  for i, slot := range layout {
+    sources[i] = -1
+    for j, c := range img.Palette {
+      if !matched[j] && palette.Equal(c, slot.Color) {
+        sources[i] = j
+        matched[j] = true
+        break
+      }
+    }
+  }
+  for i, slot := range layout {
+    if sources[i] >= 0 { continue }
+    for j, c := range img.Palette {
+      if !matched[j] && containsNear(color.Palette{ slot.Color }, c) {
+        sources[i] = j
+        matched[j] = true
+        break
+      }
+    }
+    if sources[i] < 0 {
+      return nil, newError("PaletteLayout.Apply", ErrValueOutOfRange, "color %v of palette index %d not found", slot.Color, slot.Index)
+    }
+  }
+  size := len(img.Palette)
+  for _, slot := range layout {
+    if slot.Index >= size { size = slot.Index + 1 }
+  }
+  if size > 256 { return nil, newError("PaletteLayout.Apply", ErrValueOutOfRange, "%d colors in palette", size) }
+
+  pal := make(color.Palette, size)
+  var lut [256]byte
+  for i, slot := range layout {
+    pal[slot.Index] = slot.Color
+    lut[sources[i]] = byte(slot.Index)
+  }
+  next := 0
+  for j, c := range img.Palette {
+    if matched[j] { continue }
+    for pal[next] != nil { next++ }
+    pal[next] = c
+    lut[j] = byte(next)
+  }
+  for i := range pal {
+    if pal[i] == nil { pal[i] = color.NRGBA{ 0, 0, 0, 255 } }
+  }
+
+  retVal := image.NewPaletted(img.Rect, pal)
+  for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+    sofs, dofs := img.PixOffset(img.Rect.Min.X, y), retVal.PixOffset(img.Rect.Min.X, y)
+    for x := 0; x < img.Rect.Dx(); x++ {
+      retVal.Pix[dofs+x] = lut[img.Pix[sofs+x]]
+    }
+  }
+  return retVal, nil
+}
+
+
+// Used internally. Checks whether all slots refer to distinct indices in range 0-255 and define a color.
+func (layout PaletteLayout) validate() error {
+  var used [256]bool
+  for _, slot := range layout {
+    if slot.Index < 0 || slot.Index > 255 || used[slot.Index] {
+      return newError("PaletteLayout", ErrValueOutOfRange, "palette index %d", slot.Index)
+    }
+    if slot.Color == nil { return newError("PaletteLayout", ErrInvalidPointer, "palette index %d", slot.Index) }
+    used[slot.Index] = true
+  }
+  return nil
+}
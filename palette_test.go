@@ -0,0 +1,167 @@
+package imagequant
+
+import (
+  "errors"
+  "image"
+  "image/color"
+  "testing"
+
+  "github.com/InfinityTools/go-imagequant/internal/palette"
+)
+
+
+func TestRemapToPalette(t *testing.T) {
+  pal := color.Palette{
+    color.NRGBA{ 0, 0, 0, 255 }, color.NRGBA{ 255, 255, 255, 255 }, color.NRGBA{ 255, 0, 0, 255 },
+    color.NRGBA{ 0, 255, 0, 255 }, color.NRGBA{ 0, 0, 255, 255 }, color.NRGBA{ 128, 128, 128, 255 },
+    color.NRGBA{ 0, 0, 0, 0 }, color.NRGBA{ 255, 0, 255, 128 },
+  }
+  src := gradientImage(16, 16).SubImage(image.Rect(2, 3, 14, 15))
+  att := CreateAttributes()
+  defer att.Release()
+  for _, n := range []int{ 1, 2, 3, len(pal) } {
+    for _, level := range []float32{ 0, 1 } {
+      got, err := att.RemapToPalette(src, pal[:n], level)
+      if err != nil { t.Fatalf("%d colors, dithering %v: %v", n, level, err) }
+      if got.Rect != src.Bounds() { t.Errorf("%d colors: got bounds %v, want %v", n, got.Rect, src.Bounds()) }
+      if len(got.Palette) != n { t.Fatalf("%d colors: got palette of %d colors", n, len(got.Palette)) }
+      for i := range got.Palette {
+        if !palette.Equal(got.Palette[i], pal[i]) { t.Errorf("%d colors: got color %v at %d, want %v", n, got.Palette[i], i, pal[i]) }
+      }
+      for i, v := range got.Pix {
+        if int(v) >= n { t.Fatalf("%d colors, dithering %v: got index %d at offset %d", n, level, v, i) }
+      }
+    }
+  }
+
+  for _, n := range []int{ 0, 257 } {
+    var qerr *Error
+    if _, err := att.RemapToPalette(src, make(color.Palette, n), 0); !errors.Is(err, ErrValueOutOfRange) || !errors.As(err, &qerr) {
+      t.Errorf("%d colors: got %v, want ErrValueOutOfRange", n, err)
+    }
+  }
+}
+
+func TestRemapToPaletteColors(t *testing.T) {
+  red, blue := color.NRGBA{ 255, 0, 0, 255 }, color.NRGBA{ 0, 0, 255, 255 }
+  tests := []struct {
+    name          string
+    pal           color.Palette
+    posterization int
+  }{
+    { "duplicates", color.Palette{ red, red, blue, Color{ 255, 0, 0, 255 }, blue }, 0 },
+    { "single distinct color", color.Palette{ blue, blue }, 0 },
+    { "translucent", color.Palette{ color.NRGBA{ 0, 0, 0, 0 }, color.NRGBA{ 255, 0, 0, 51 }, color.NRGBA{ 0, 255, 0, 128 },
+                                    color.NRGBA{ 17, 99, 201, 200 }, red }, 0 },
+    // colors must not be posterized
+    { "posterized", color.Palette{ color.NRGBA{ 1, 2, 3, 255 }, color.NRGBA{ 127, 129, 131, 255 }, color.NRGBA{ 253, 254, 255, 255 } }, 4 },
+  }
+  for _, tt := range tests {
+    // every pixel has the exact color of a palette entry
+    src := image.NewNRGBA(image.Rect(1, 1, 11, 9))
+    for y := 1; y < 9; y++ {
+      for x := 1; x < 11; x++ { src.Set(x, y, tt.pal[(x + y) % len(tt.pal)]) }
+    }
+    att := CreateAttributes()
+    if err := att.SetMinPosterization(tt.posterization); err != nil { t.Fatal(err) }
+    got, err := att.RemapToPalette(src, tt.pal, 0)
+    att.Release()
+    if err != nil { t.Errorf("%s: %v", tt.name, err); continue }
+    if len(got.Palette) != len(tt.pal) { t.Errorf("%s: got palette %v, want %v", tt.name, got.Palette, tt.pal); continue }
+    for i := range tt.pal {
+      if !palette.Equal(got.Palette[i], tt.pal[i]) { t.Errorf("%s: got color %v at %d, want %v", tt.name, got.Palette[i], i, tt.pal[i]) }
+    }
+    for y := 1; y < 9; y++ {
+      for x := 1; x < 11; x++ {
+        // pixels refer to the first occurrence of their color
+        want := tt.pal[(x + y) % len(tt.pal)]
+        first := 0
+        for !palette.Equal(tt.pal[first], want) { first++ }
+        if idx := got.ColorIndexAt(x, y); int(idx) != first { t.Errorf("%s: got index %d at (%d, %d), want %d", tt.name, idx, x, y, first) }
+      }
+    }
+  }
+
+  att := CreateAttributes()
+  defer att.Release()
+  _, err := att.RemapToPalette(gradientImage(4, 4), color.Palette{ red, nil }, 0)
+  var qerr *Error
+  if !errors.Is(err, ErrInvalidPointer) || !errors.As(err, &qerr) { t.Errorf("got %v, want *Error wrapping ErrInvalidPointer", err) }
+}
+
+// Used internally. Checks whether both images have the same bounds and pixel colors.
+func samePixels(t *testing.T, got, want *image.Paletted) {
+  t.Helper()
+  if got.Rect != want.Rect { t.Fatalf("got bounds %v, want %v", got.Rect, want.Rect) }
+  for y := want.Rect.Min.Y; y < want.Rect.Max.Y; y++ {
+    for x := want.Rect.Min.X; x < want.Rect.Max.X; x++ {
+      if g, w := got.At(x, y), want.At(x, y); !containsNear(color.Palette{ w }, g) { t.Fatalf("pixel (%d, %d): got %v, want %v", x, y, g, w) }
+    }
+  }
+}
+
+func TestPaletteLayout(t *testing.T) {
+  red, green, blue := color.NRGBA{ 255, 0, 0, 255 }, color.NRGBA{ 0, 255, 0, 255 }, color.NRGBA{ 0, 0, 255, 255 }
+  key := color.NRGBA{ 255, 0, 255, 0 }
+  black := color.NRGBA{ 0, 0, 0, 255 }
+  src := image.NewPaletted(image.Rect(1, 2, 5, 6), color.Palette{ red, green, blue, key, color.NRGBA{ 0, 254, 1, 255 } })
+  for i := range src.Pix { src.Pix[i] = uint8(i % len(src.Palette)) }
+
+  tests := []struct {
+    name    string
+    layout  PaletteLayout
+    want    color.Palette // nil if an error is expected
+  }{
+    { "empty", nil, src.Palette },
+    { "reorder", PaletteLayout{ { 0, key }, { 1, blue } }, color.Palette{ key, blue, red, green, src.Palette[4] } },
+    { "same index", PaletteLayout{ { 1, green } }, src.Palette },
+    // the exact match takes precedence over the rounded color at index 4
+    { "exact match", PaletteLayout{ { 4, color.NRGBA{ 0, 254, 1, 255 } }, { 0, green } },
+      color.Palette{ green, red, blue, key, src.Palette[4] } },
+    { "rounded color", PaletteLayout{ { 0, color.NRGBA{ 1, 255, 0, 255 } }, { 1, color.NRGBA{ 0, 255, 0, 255 } } },
+      color.Palette{ color.NRGBA{ 1, 255, 0, 255 }, green, red, blue, key } },
+    { "padding", PaletteLayout{ { 7, red } }, color.Palette{ green, blue, key, src.Palette[4], black, black, black, red } },
+    { "missing color", PaletteLayout{ { 0, color.NRGBA{ 0, 128, 0, 255 } } }, nil },
+    { "duplicate color", PaletteLayout{ { 0, red }, { 1, red } }, nil },
+    { "duplicate index", PaletteLayout{ { 0, red }, { 0, green } }, nil },
+    { "index out of range", PaletteLayout{ { 256, red } }, nil },
+  }
+  for _, tt := range tests {
+    got, err := tt.layout.Apply(src)
+    if tt.want == nil {
+      var qerr *Error
+      if !errors.Is(err, ErrValueOutOfRange) || !errors.As(err, &qerr) { t.Errorf("%s: got %v, want *Error wrapping ErrValueOutOfRange", tt.name, err) }
+      continue
+    }
+    if err != nil { t.Errorf("%s: %v", tt.name, err); continue }
+    if len(got.Palette) != len(tt.want) { t.Errorf("%s: got palette %v, want %v", tt.name, got.Palette, tt.want); continue }
+    for i := range tt.want {
+      if !palette.Equal(got.Palette[i], tt.want[i]) { t.Errorf("%s: got palette %v, want %v", tt.name, got.Palette, tt.want); break }
+    }
+    samePixels(t, got, src)
+  }
+
+  if _, err := (PaletteLayout{ { 0, nil } }).Apply(src); !errors.Is(err, ErrInvalidPointer) { t.Errorf("got %v, want ErrInvalidPointer", err) }
+}
+
+func TestWriteRemappedImageLayout(t *testing.T) {
+  layout := PaletteLayout{ { 0, Color{ 255, 0, 255, 0 } }, { 1, Color{ 255, 255, 255, 255 } } }
+  att := CreateAttributes()
+  defer att.Release()
+  img, err := att.NewImage(gradientImage(16, 16), 0)
+  if err != nil { t.Fatal(err) }
+  defer img.Close()
+  if err = att.AddImagePaletteLayout(img, layout); err != nil { t.Fatal(err) }
+  res, err := att.QuantizeImage(img)
+  if err != nil { t.Fatal(err) }
+  defer res.Close()
+  if err = att.SetDitheringLevel(res, 0); err != nil { t.Fatal(err) }
+  remapped, err := att.WriteRemappedImage(res, img)
+  if err != nil { t.Fatal(err) }
+  got, err := att.WriteRemappedImageLayout(res, img, layout)
+  if err != nil { t.Fatal(err) }
+  for _, slot := range layout {
+    if !palette.Equal(got.Palette[slot.Index], slot.Color) { t.Errorf("got color %v at %d, want %v", got.Palette[slot.Index], slot.Index, slot.Color) }
+  }
+  samePixels(t, got, remapped.(*image.Paletted))
+}
@@ -0,0 +1,133 @@
+package png
+// Reordering of palette entries for better compression.
+
+import (
+  "image"
+  "image/color"
+  "sort"
+
+  "github.com/InfinityTools/go-imagequant/internal/palette"
+  "github.com/InfinityTools/go-imagequant/internal/pngchunk"
+)
+
+
+// Returns a copy of img with the palette entries in the order used by Encode. Pixel indices are translated accordingly.
+//
+// If OptimizePalette is set, palette orders sorted by luminance, by frequency and by a walk along the most frequent
+// neighbors of adjacent pixels are tried in addition to the original order. An order is only used if it reduces the
+// size of the compressed image data. The placement of translucent entries described in Encode is retained in all cases.
+func (e *Encoder) Optimize(img *image.Paletted) (*image.Paletted, error) {
+  if err := validate(img); err != nil { return nil, err }
+  retVal, _, err := e.optimize(img)
+  return retVal, err
+}
+
+
+// Used internally. Returns the reordered image together with its compressed image data.
+func (e *Encoder) optimize(img *image.Paletted) (*image.Paletted, []byte, error) {
+  identity := make([]int, len(img.Palette))
+  for i := range identity { identity[i] = i }
+  orders := [][]int{ identity }
+  if e.OptimizePalette {
+    counts := countColors(img)
+    orders = append(orders, byLuminance(img.Palette), byFrequency(counts), nearestNeighbors(img, counts))
+  }
+
+  var best *image.Paletted
+  var bestData []byte
+  for _, order := range orders {
+    if e.LastIndexTransparent {
+      order = transparentLast(img.Palette, order)
+    } else {
+      order = alphaFirst(img.Palette, order)
+    }
+    candidate := palette.Permute(img, order)
+    data, err := e.compress(candidate)
+    if err != nil { return nil, nil, err }
+    if best == nil || len(data) < len(bestData) { best, bestData = candidate, data }
+  }
+  return best, bestData, nil
+}
+
+// Used internally. Returns the compressed image data of img.
+func (e *Encoder) compress(img *image.Paletted) ([]byte, error) {
+  depth := bitDepth(len(img.Palette))
+  rowSize := (img.Bounds().Dx() * depth + 7) / 8
+  return pngchunk.Compress(packRows(img, depth, rowSize), rowSize, rowSize, img.Bounds().Dy(), e.zlibLevel())
+}
+
+// Used internally. Returns the number of pixels for each palette index.
+func countColors(img *image.Paletted) []int {
+  counts := make([]int, 256)
+  b := img.Bounds()
+  for y := b.Min.Y; y < b.Max.Y; y++ {
+    ofs := img.PixOffset(b.Min.X, y)
+    for _, v := range img.Pix[ofs:ofs+b.Dx()] { counts[v]++ }
+  }
+  return counts[:len(img.Palette)]
+}
+
+// Used internally. Returns a palette order sorted by luminance, then by alpha.
+func byLuminance(p color.Palette) []int {
+  luma := make([]int, len(p))
+  order := make([]int, len(p))
+  for i, c := range p {
+    nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+    luma[i] = (299 * int(nc.R) + 587 * int(nc.G) + 114 * int(nc.B)) << 8 | int(nc.A)
+    order[i] = i
+  }
+  sort.SliceStable(order, func(i, j int) bool { return luma[order[i]] < luma[order[j]] })
+  return order
+}
+
+// Used internally. Returns a palette order sorted by descending pixel count.
+func byFrequency(counts []int) []int {
+  order := make([]int, len(counts))
+  for i := range order { order[i] = i }
+  sort.SliceStable(order, func(i, j int) bool { return counts[order[i]] > counts[order[j]] })
+  return order
+}
+
+// Used internally. Returns a palette order that starts with the most frequent color and continues with the color that
+// is most often adjacent to the previous color, so that neighboring pixels tend to have similar indices.
+func nearestNeighbors(img *image.Paletted, counts []int) []int {
+  n := len(counts)
+  adjacent := make([]int, n * n)
+  b := img.Bounds()
+  for y := b.Min.Y; y < b.Max.Y; y++ {
+    ofs := img.PixOffset(b.Min.X, y)
+    row := img.Pix[ofs:ofs+b.Dx()]
+    for x, v := range row {
+      if x + 1 < len(row) && row[x+1] != v {
+        adjacent[int(v)*n + int(row[x+1])]++
+        adjacent[int(row[x+1])*n + int(v)]++
+      }
+      if y + 1 < b.Max.Y {
+        if w := img.Pix[ofs+img.Stride+x]; w != v {
+          adjacent[int(v)*n + int(w)]++
+          adjacent[int(w)*n + int(v)]++
+        }
+      }
+    }
+  }
+
+  order := make([]int, 0, n)
+  used := make([]bool, n)
+  last := -1
+  for len(order) < n {
+    next := -1
+    for i := 0; i < n; i++ {
+      if used[i] { continue }
+      if next < 0 { next = i; continue }
+      if last >= 0 && adjacent[last*n + i] != adjacent[last*n + next] {
+        if adjacent[last*n + i] > adjacent[last*n + next] { next = i }
+      } else if counts[i] > counts[next] {
+        next = i
+      }
+    }
+    order = append(order, next)
+    used[next] = true
+    last = next
+  }
+  return order
+}
@@ -0,0 +1,189 @@
+/*
+Package png writes paletted PNG images, such as the images created by the imagequant library, as compact as possible.
+
+Compared to the image/png package, palette entries are reordered so that the tRNS chunk contains only the translucent
+entries, the smallest possible bit depth is used and the output gamma can be stored in the file.
+*/
+package png
+
+import (
+  "bufio"
+  "compress/zlib"
+  "encoding/binary"
+  "fmt"
+  "image"
+  "image/color"
+  "io"
+  "math"
+
+  "github.com/InfinityTools/go-imagequant"
+  "github.com/InfinityTools/go-imagequant/internal/pngchunk"
+)
+
+
+// CompressionLevel indicates the compression level. Values are the same as in the image/png package.
+type CompressionLevel int
+
+const (
+  DefaultCompression  CompressionLevel = 0
+  NoCompression       CompressionLevel = -1
+  BestSpeed           CompressionLevel = -2
+  BestCompression     CompressionLevel = -3
+)
+
+// Gamma of the sRGB color space as used by the library, see SetOutputGamma.
+const GammaSRGB = 0.45455
+
+// Encoder configures encoding of paletted PNG images.
+type Encoder struct {
+  CompressionLevel      CompressionLevel
+  // Gamma is stored in a gAMA chunk if it is > 0, e.g. the value returned by GetOutputGamma. An sRGB chunk is
+  // written in addition if Gamma matches GammaSRGB.
+  Gamma                 float64
+  // OptimizePalette enables reordering of palette entries to reduce the size of the compressed image data.
+  // See Optimize.
+  OptimizePalette       bool
+  // LastIndexTransparent keeps a fully transparent palette entry at the last index instead of moving translucent
+  // entries to the start of the palette. Use it for images quantized with SetLastIndexTransparent.
+  LastIndexTransparent  bool
+}
+
+
+// Writes the paletted image img to w in PNG format with default settings.
+func Encode(w io.Writer, img *image.Paletted) error {
+  var e Encoder
+  return e.Encode(w, img)
+}
+
+// Writes the paletted image img to w in PNG format.
+//
+// Translucent palette entries are moved to the start of the palette, so that the tRNS chunk can be truncated after
+// the last translucent entry, unless LastIndexTransparent is set. The tRNS chunk is omitted if all palette entries
+// are opaque. The bit depth is chosen from the palette size. img is not modified.
+//
+// Returns an error wrapping imagequant.ErrValueOutOfRange if the palette is empty or contains more than 256 entries,
+// or if a pixel refers to a missing palette entry.
+func (e *Encoder) Encode(w io.Writer, img *image.Paletted) error {
+  if err := validate(img); err != nil { return err }
+  img, data, err := e.optimize(img)
+  if err != nil { return err }
+  plte, trns := pngchunk.EncodePalette(img.Palette)
+  depth := bitDepth(len(img.Palette))
+  b := img.Bounds()
+
+  bw := bufio.NewWriter(w)
+  if err = pngchunk.WriteSignature(bw); err != nil { return err }
+  ihdr := make([]byte, 13)
+  binary.BigEndian.PutUint32(ihdr[0:], uint32(b.Dx()))
+  binary.BigEndian.PutUint32(ihdr[4:], uint32(b.Dy()))
+  ihdr[8], ihdr[9] = byte(depth), 3 // paletted color type
+  if err = pngchunk.WriteChunk(bw, "IHDR", ihdr); err != nil { return err }
+  if e.Gamma > 0 {
+    if math.Abs(e.Gamma - GammaSRGB) < 0.00001 {
+      // rendering intent: perceptual
+      if err = pngchunk.WriteChunk(bw, "sRGB", []byte{ 0 }); err != nil { return err }
+    }
+    gama := make([]byte, 4)
+    binary.BigEndian.PutUint32(gama, uint32(math.Round(e.Gamma * 100000)))
+    if err = pngchunk.WriteChunk(bw, "gAMA", gama); err != nil { return err }
+  }
+  if err = pngchunk.WriteChunk(bw, "PLTE", plte); err != nil { return err }
+  if len(trns) > 0 {
+    if err = pngchunk.WriteChunk(bw, "tRNS", trns); err != nil { return err }
+  }
+  if err = pngchunk.WriteChunk(bw, "IDAT", data); err != nil { return err }
+  if err = pngchunk.WriteChunk(bw, "IEND", nil); err != nil { return err }
+  return bw.Flush()
+}
+
+
+// Used internally. Checks whether img can be encoded.
+func validate(img *image.Paletted) error {
+  if img == nil { return imagequant.ErrInvalidPointer }
+  if len(img.Palette) == 0 || len(img.Palette) > 256 {
+    return fmt.Errorf("%d colors in palette: %w", len(img.Palette), imagequant.ErrValueOutOfRange)
+  }
+  b := img.Bounds()
+  if b.Empty() { return fmt.Errorf("image size %dx%d: %w", b.Dx(), b.Dy(), imagequant.ErrValueOutOfRange) }
+  for y := b.Min.Y; y < b.Max.Y; y++ {
+    ofs := img.PixOffset(b.Min.X, y)
+    for _, v := range img.Pix[ofs:ofs+b.Dx()] {
+      if int(v) >= len(img.Palette) { return fmt.Errorf("palette index %d: %w", v, imagequant.ErrValueOutOfRange) }
+    }
+  }
+  return nil
+}
+
+// Used internally. Returns the zlib compression level.
+func (e *Encoder) zlibLevel() int {
+  switch e.CompressionLevel {
+  case NoCompression:
+    return zlib.NoCompression
+  case BestSpeed:
+    return zlib.BestSpeed
+  case BestCompression:
+    return zlib.BestCompression
+  default:
+    return zlib.DefaultCompression
+  }
+}
+
+// Used internally. Returns the order with all translucent entries first. The order is preserved otherwise.
+func alphaFirst(p color.Palette, order []int) []int {
+  retVal := make([]int, 0, len(order))
+  for pass := 0; pass < 2; pass++ {
+    for _, i := range order {
+      if _, _, _, a := p[i].RGBA(); (a != 0xffff) == (pass == 0) { retVal = append(retVal, i) }
+    }
+  }
+  return retVal
+}
+
+// Used internally. Returns the order with the last fully transparent entry of the palette moved to the end.
+// The order is preserved otherwise.
+func transparentLast(p color.Palette, order []int) []int {
+  t := -1
+  for i, c := range p {
+    if _, _, _, a := c.RGBA(); a == 0 { t = i }
+  }
+  retVal := make([]int, 0, len(order))
+  for _, i := range order {
+    if i != t { retVal = append(retVal, i) }
+  }
+  if t >= 0 { retVal = append(retVal, t) }
+  return retVal
+}
+
+// Used internally. Returns the smallest bit depth that can represent the given number of palette entries.
+func bitDepth(colors int) int {
+  switch {
+  case colors <= 2:
+    return 1
+  case colors <= 4:
+    return 2
+  case colors <= 16:
+    return 4
+  default:
+    return 8
+  }
+}
+
+// Used internally. Returns the pixels of img packed at the given bit depth, with rowSize bytes per row.
+func packRows(img *image.Paletted, depth, rowSize int) []byte {
+  b := img.Bounds()
+  retVal := make([]byte, rowSize * b.Dy())
+  perByte := 8 / depth
+  for y := 0; y < b.Dy(); y++ {
+    src := img.Pix[img.PixOffset(b.Min.X, b.Min.Y + y):]
+    dst := retVal[y*rowSize:(y+1)*rowSize]
+    if depth == 8 {
+      copy(dst, src[:b.Dx()])
+      continue
+    }
+    for x := 0; x < b.Dx(); x++ {
+      shift := uint(8 - depth * (x % perByte + 1))
+      dst[x/perByte] |= src[x] << shift
+    }
+  }
+  return retVal
+}
@@ -0,0 +1,180 @@
+package png
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "image"
+  "image/color"
+  "image/png"
+  "testing"
+
+  "github.com/InfinityTools/go-imagequant"
+  "github.com/InfinityTools/go-imagequant/internal/pngchunk"
+)
+
+
+// Used internally. Returns an image with a palette of n colors. The first entries of the palette are taken from
+// special, all others are distinct opaque colors. Pixels use all palette entries.
+func testImage(r image.Rectangle, n int, special ...color.Color) *image.Paletted {
+  p := make(color.Palette, n)
+  for i := range p {
+    if i < len(special) {
+      p[i] = special[i]
+    } else {
+      p[i] = color.NRGBA{ byte(i), byte(255 - i), byte(i * 7), 255 }
+    }
+  }
+  img := image.NewPaletted(r, p)
+  for y := r.Min.Y; y < r.Max.Y; y++ {
+    for x := r.Min.X; x < r.Max.X; x++ { img.SetColorIndex(x, y, byte((x * 3 + y * 5) % n)) }
+  }
+  return img
+}
+
+// Used internally. Returns the chunks of a PNG image by type.
+func readChunks(t *testing.T, data []byte) map[string][]byte {
+  t.Helper()
+  r := bytes.NewReader(data)
+  if err := pngchunk.ReadSignature(r); err != nil { t.Fatal(err) }
+  chunks := make(map[string][]byte)
+  for r.Len() > 0 {
+    chunkType, chunk, err := pngchunk.ReadChunk(r)
+    if err != nil { t.Fatal(err) }
+    chunks[chunkType] = chunk
+  }
+  return chunks
+}
+
+// Used internally. Checks whether the decoded image has the same size and pixel colors as the source image.
+func samePixels(t *testing.T, name string, got image.Image, want *image.Paletted) {
+  t.Helper()
+  b := want.Bounds()
+  if got.Bounds() != image.Rect(0, 0, b.Dx(), b.Dy()) { t.Fatalf("%s: got bounds %v, want size %v", name, got.Bounds(), b.Size()) }
+  for y := 0; y < b.Dy(); y++ {
+    for x := 0; x < b.Dx(); x++ {
+      g := color.NRGBAModel.Convert(got.At(x, y))
+      if w := color.NRGBAModel.Convert(want.At(b.Min.X + x, b.Min.Y + y)); g != w { t.Fatalf("%s: pixel (%d, %d): got %v, want %v", name, x, y, g, w) }
+    }
+  }
+}
+
+
+func TestEncode(t *testing.T) {
+  transparent, translucent := color.NRGBA{ 0, 0, 0, 0 }, color.NRGBA{ 255, 0, 0, 128 }
+  tests := []struct {
+    name    string
+    img     *image.Paletted
+    enc     Encoder
+    depth   byte
+    trns    int     // length of the tRNS chunk, -1 if it is omitted
+    gamma   uint32  // content of the gAMA chunk, 0 if it is omitted
+    srgb    bool
+  }{
+    { "1 bit", testImage(image.Rect(0, 0, 13, 3), 2), Encoder{}, 1, -1, 0, false },
+    { "2 bits", testImage(image.Rect(0, 0, 7, 5), 3), Encoder{}, 2, -1, 0, false },
+    { "2 bits, 4 colors", testImage(image.Rect(0, 0, 5, 2), 4), Encoder{}, 2, -1, 0, false },
+    { "4 bits, 5 colors", testImage(image.Rect(0, 0, 3, 4), 5), Encoder{}, 4, -1, 0, false },
+    { "4 bits, 16 colors", testImage(image.Rect(0, 0, 17, 3), 16), Encoder{}, 4, -1, 0, false },
+    { "8 bits, 17 colors", testImage(image.Rect(0, 0, 17, 3), 17), Encoder{}, 8, -1, 0, false },
+    { "1 bit sub-image", testImage(image.Rect(5, 2, 30, 20), 2).SubImage(image.Rect(7, 5, 18, 9)).(*image.Paletted),
+      Encoder{}, 1, -1, 0, false },
+    { "2 bits sub-image", testImage(image.Rect(0, 0, 30, 20), 4).SubImage(image.Rect(3, 2, 12, 9)).(*image.Paletted),
+      Encoder{}, 2, -1, 0, false },
+    { "4 bits sub-image", testImage(image.Rect(0, 0, 30, 20), 9).SubImage(image.Rect(3, 2, 10, 9)).(*image.Paletted),
+      Encoder{}, 4, -1, 0, false },
+    // translucent entries are moved to the start of the palette
+    { "tRNS truncated", testImage(image.Rect(0, 0, 9, 9), 20, color.NRGBA{ 0, 0, 255, 255 }, translucent, transparent),
+      Encoder{}, 8, 2, 0, false },
+    { "LastIndexTransparent", testImage(image.Rect(0, 0, 9, 9), 20, transparent, translucent),
+      Encoder{ LastIndexTransparent: true }, 8, 20, 0, false },
+    { "LastIndexTransparent without transparent color", testImage(image.Rect(0, 0, 9, 9), 20, translucent),
+      Encoder{ LastIndexTransparent: true }, 8, 1, 0, false },
+    { "sRGB", testImage(image.Rect(0, 0, 4, 4), 2), Encoder{ Gamma: GammaSRGB }, 1, -1, 45455, true },
+    { "gAMA", testImage(image.Rect(0, 0, 4, 4), 2), Encoder{ Gamma: 0.5 }, 1, -1, 50000, false },
+    { "optimized", testImage(image.Rect(0, 0, 32, 32), 40, translucent), Encoder{ OptimizePalette: true }, 8, 1, 0, false },
+    { "optimized, LastIndexTransparent", testImage(image.Rect(0, 0, 32, 32), 40, transparent, translucent),
+      Encoder{ OptimizePalette: true, LastIndexTransparent: true }, 8, 40, 0, false },
+    { "best compression", testImage(image.Rect(0, 0, 32, 32), 5), Encoder{ CompressionLevel: BestCompression }, 4, -1, 0, false },
+    { "no compression", testImage(image.Rect(0, 0, 32, 32), 5), Encoder{ CompressionLevel: NoCompression }, 4, -1, 0, false },
+  }
+  for _, tt := range tests {
+    var buf bytes.Buffer
+    if err := tt.enc.Encode(&buf, tt.img); err != nil { t.Fatalf("%s: %v", tt.name, err) }
+    data := buf.Bytes()
+    got, err := png.Decode(bytes.NewReader(data))
+    if err != nil { t.Fatalf("%s: %v", tt.name, err) }
+    samePixels(t, tt.name, got, tt.img)
+
+    chunks := readChunks(t, data)
+    if d := chunks["IHDR"][8]; d != tt.depth { t.Errorf("%s: got bit depth %d, want %d", tt.name, d, tt.depth) }
+    if n := len(chunks["PLTE"]) / 3; n != len(tt.img.Palette) { t.Errorf("%s: got %d palette entries, want %d", tt.name, n, len(tt.img.Palette)) }
+    trns, ok := chunks["tRNS"]
+    if n := len(trns); (tt.trns < 0 && ok) || (tt.trns >= 0 && n != tt.trns) { t.Errorf("%s: got tRNS chunk of %d bytes, want %d", tt.name, n, tt.trns) }
+    if tt.enc.LastIndexTransparent && tt.trns == len(tt.img.Palette) && len(trns) > 0 && trns[len(trns)-1] != 0 {
+      t.Errorf("%s: got alpha %d of last palette entry", tt.name, trns[len(trns)-1])
+    }
+    gama, ok := chunks["gAMA"]
+    if (tt.gamma == 0 && ok) || (tt.gamma != 0 && (len(gama) != 4 || binary.BigEndian.Uint32(gama) != tt.gamma)) {
+      t.Errorf("%s: got gAMA chunk %v, want %d", tt.name, gama, tt.gamma)
+    }
+    if _, ok = chunks["sRGB"]; ok != tt.srgb { t.Errorf("%s: got sRGB chunk %v, want %v", tt.name, ok, tt.srgb) }
+
+    // reordering palette entries must never increase the size
+    unoptimized, optimized := tt.enc, tt.enc
+    unoptimized.OptimizePalette, optimized.OptimizePalette = false, true
+    var ubuf, obuf bytes.Buffer
+    if err = unoptimized.Encode(&ubuf, tt.img); err != nil { t.Fatalf("%s: %v", tt.name, err) }
+    if err = optimized.Encode(&obuf, tt.img); err != nil { t.Fatalf("%s: %v", tt.name, err) }
+    if obuf.Len() > ubuf.Len() { t.Errorf("%s: got %d bytes optimized, %d bytes unoptimized", tt.name, obuf.Len(), ubuf.Len()) }
+    if got, err = png.Decode(&obuf); err != nil { t.Fatalf("%s: %v", tt.name, err) }
+    samePixels(t, tt.name + " (optimized)", got, tt.img)
+  }
+}
+
+func TestEncodeInvalid(t *testing.T) {
+  outOfRange := testImage(image.Rect(0, 0, 4, 4), 3)
+  outOfRange.Pix[5] = 3
+  tests := []struct {
+    name  string
+    img   *image.Paletted
+    want  error
+  }{
+    { "nil", nil, imagequant.ErrInvalidPointer },
+    { "empty palette", image.NewPaletted(image.Rect(0, 0, 4, 4), nil), imagequant.ErrValueOutOfRange },
+    { "257 colors", testImage(image.Rect(0, 0, 4, 4), 257), imagequant.ErrValueOutOfRange },
+    { "empty image", image.NewPaletted(image.Rect(0, 0, 0, 4), color.Palette{ color.Black }), imagequant.ErrValueOutOfRange },
+    { "index out of range", outOfRange, imagequant.ErrValueOutOfRange },
+  }
+  for _, tt := range tests {
+    if err := Encode(&bytes.Buffer{}, tt.img); !errors.Is(err, tt.want) { t.Errorf("%s: got %v, want %v", tt.name, err, tt.want) }
+  }
+}
+
+func TestPaletteOrders(t *testing.T) {
+  white, black, gray := color.NRGBA{ 255, 255, 255, 255 }, color.NRGBA{ 0, 0, 0, 255 }, color.NRGBA{ 128, 128, 128, 255 }
+  transparent := color.NRGBA{ 0, 0, 0, 0 }
+  img := image.NewPaletted(image.Rect(0, 0, 9, 1), color.Palette{ white, black, gray })
+  copy(img.Pix, []byte{ 0, 0, 0, 0, 0, 2, 1, 1, 1 })
+  counts := countColors(img)
+  tests := []struct {
+    name  string
+    got   []int
+    want  []int
+  }{
+    { "byLuminance", byLuminance(img.Palette), []int{ 1, 2, 0 } },
+    { "byFrequency", byFrequency(counts), []int{ 0, 1, 2 } },
+    // gray is adjacent to white, black is not
+    { "nearestNeighbors", nearestNeighbors(img, counts), []int{ 0, 2, 1 } },
+    { "alphaFirst", alphaFirst(color.Palette{ white, transparent, gray, color.NRGBA{ 0, 0, 0, 1 } }, []int{ 0, 1, 2, 3 }), []int{ 1, 3, 0, 2 } },
+    // only the last fully transparent entry is moved
+    { "transparentLast", transparentLast(color.Palette{ transparent, white, transparent, gray }, []int{ 3, 2, 1, 0 }), []int{ 3, 1, 0, 2 } },
+    { "transparentLast without transparent entry", transparentLast(color.Palette{ white, gray }, []int{ 1, 0 }), []int{ 1, 0 } },
+  }
+  for _, tt := range tests {
+    if len(tt.got) != len(tt.want) { t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want); continue }
+    for i := range tt.want {
+      if tt.got[i] != tt.want[i] { t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want); break }
+    }
+  }
+}
@@ -1,7 +1,18 @@
 package imagequant
 
 /*
+#include <stdint.h>
 #include "libimagequant.h"
+
+extern int goProgressCallback(float, void*);
+
+static void setResultProgressCallback(liq_result *res, uintptr_t handle) {
+  if (handle != 0) {
+    liq_result_set_progress_callback(res, goProgressCallback, (void*)handle);
+  } else {
+    liq_result_set_progress_callback(res, NULL, NULL);
+  }
+}
 */
 import "C"
 
@@ -20,29 +31,40 @@ const (
 
 // Result struct is required by several functions. Don't access the content directly.
 type Result struct {
-  result    *C.struct_liq_result
+  result          *C.struct_liq_result
+  lock            guard
+  progress        ProgressCallback
+  progressHandle  uintptr
 }
 
 
 // Generates a palette from the histogram. On success returns the fully initialized Result object.
+//
+// Returns a nil Result object on error.
 func (att *Attributes) QuantizeHistogram(hist *Histogram) (res *Result, err error) {
+  if !acquireAll(att, exclusive{hist}) { return nil, invalidPointer("liq_histogram_quantize") }
+  defer releaseAll(att, exclusive{hist})
   res = new(Result)
-  code := C.liq_histogram_quantize(hist.histogram, att.attr, (**C.struct_liq_result)(unsafe.Pointer(&res.result)))
-  runtime.SetFinalizer(res, freeResult)
-  err = getError(code)
-  return
+  var code C.liq_error
+  att.account.run(func() {
+    code = C.liq_histogram_quantize(hist.histogram, att.attr, (**C.struct_liq_result)(unsafe.Pointer(&res.result)))
+  })
+  return finishResult(res, getError("liq_histogram_quantize", code))
 }
 
 // Performs quantization (palette generation) based on current Quantizer settings and pixels of the image.
 //
-// Returns the Result object if quantization succeeds.
+// Returns the Result object if quantization succeeds, and a nil Result object otherwise.
 // Error returns ErrQualityTooLow if quantization fails due to limit set in SetQuality.
 func (att *Attributes) QuantizeImage(img *Image) (res *Result, err error) {
+  if !acquireAll(att, exclusive{img}) { return nil, invalidPointer("liq_image_quantize") }
+  defer releaseAll(att, exclusive{img})
   res = new(Result)
-  code := C.liq_image_quantize(img.image, att.attr, (**C.struct_liq_result)(unsafe.Pointer(&res.result)))
-  runtime.SetFinalizer(res, freeResult)
-  err = getError(code)
-  return
+  var code C.liq_error
+  att.account.run(func() {
+    code = C.liq_image_quantize(img.image, att.attr, (**C.struct_liq_result)(unsafe.Pointer(&res.result)))
+  })
+  return finishResult(res, img.getError("liq_image_quantize", code))
 }
 
 // Enables/disables dithering in WriteRemappedImage.
@@ -50,39 +72,60 @@ func (att *Attributes) QuantizeImage(img *Image) (res *Result, err error) {
 // Dithering level must be between 0 and 1 (inclusive). Dithering level 0 enables fast non-dithered remapping. 
 // Otherwise a variation of Floyd-Steinberg error diffusion is used.
 func (att *Attributes) SetDitheringLevel(res *Result, ditherLevel float32) error {
+  if !res.acquireExclusive() { return invalidPointer("liq_set_dithering_level") }
+  defer res.releaseExclusive()
   code := C.liq_set_dithering_level(res.result, C.float(ditherLevel))
-  return getError(code)
+  return getError("liq_set_dithering_level", code)
+}
+
+// Sets a callback function that is called periodically while remapping images with this Result object 
+// (WriteRemappedImage, WriteRemappedImageBuffer and WriteRemappedImageBufferRows).
+//
+// The callback function receives the progress in percent and returns false to abort the operation, in which case 
+// the remapping functions return ErrAborted. Specify nil to remove the callback function.
+func (att *Attributes) SetResultProgressCallback(res *Result, cb ProgressCallback) {
+  if !res.acquireExclusive() { return }
+  defer res.releaseExclusive()
+  res.setProgressCallback(cb)
 }
 
 // Sets gamma correction for generated palette and remapped image.
 //
 // Must be > 0 and < 1, e.g. 0.45455 for gamma 1/2.2 in PNG images. By default output gamma is same as gamma of the input image.
 func (att *Attributes) SetOutputGamma(res *Result, gamma float64) error {
+  if !res.acquireExclusive() { return invalidPointer("liq_set_output_gamma") }
+  defer res.releaseExclusive()
   code := C.liq_set_output_gamma(res.result, C.double(gamma))
-  return getError(code)
+  return getError("liq_set_output_gamma", code)
 }
 
 // Returns the gamma value for the output image.
 func (att *Attributes) GetOutputGamma(res *Result) float64 {
+  if !res.acquire() { return -1 }
+  defer res.release()
   return float64(C.liq_get_output_gamma(res.result))
 }
 
 // Returns a palette optimized for the image that has been quantized or remapped (final refinements are applied to the palette during remapping).
 //
 // It's valid to call this method before remapping, if you don't plan to remap any images or want to use same palette for multiple images.
+// Palette entries are of type color.NRGBA (non-premultiplied alpha), as generated by the library.
 // Returns a Palette object with 0 color entries on error.
 func (att *Attributes) GetPalette(res *Result) color.Palette {
+  if !res.acquireExclusive() { return make(color.Palette, 0) }
+  defer res.releaseExclusive()
+  return res.palette()
+}
+
+// Used internally. Returns the palette of the Result object. Exclusive access must be held by the caller.
+func (res *Result) palette() color.Palette {
   var palette color.Palette = nil
   pal := C.liq_get_palette(res.result)
   if pal != nil {
     palette = make(color.Palette, (*pal).count)
     for i := 0; i < len(palette); i++ {
-      r, g, b, a := byte((*pal).entries[i].r), byte((*pal).entries[i].g), byte((*pal).entries[i].b), byte((*pal).entries[i].a)
-      // compensating rounding errors
-      if r > a { r = a }
-      if g > a { g = a }
-      if b > a { b = a }
-      palette[i] = color.RGBA{ r, g, b, a }
+      e := (*pal).entries[i]
+      palette[i] = color.NRGBA{ byte(e.r), byte(e.g), byte(e.b), byte(e.a) }
     }
   } else {
     palette = make(color.Palette, 0)
@@ -98,10 +141,11 @@ func (att *Attributes) GetPalette(res *Result) color.Palette {
 // The returned byte array is assumed to be contiguous, with rows ordered from top to bottom, and no gaps between rows. 
 // If you need to return a sequence of rows with padding or upside-down order, then use WriteRemappedImageRows.
 func (att *Attributes) WriteRemappedImageBuffer(res *Result, img *Image) (buf []byte, err error) {
-  buf = make([]byte, att.GetImageWidth(img) * att.GetImageHeight(img))
-  code := C.liq_write_remapped_image(res.result, img.image, unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
-  err = getError(code)
-  return
+  account := att.retainAccount()
+  defer account.release()
+  if !acquireAll(remapLocks(res, img)...) { err = invalidPointer("liq_write_remapped_image"); return }
+  defer releaseAll(remapLocks(res, img)...)
+  return remapBuffer(account, res, img)
 }
 
 // Similar to WriteRemappedImageBuffer. Returns a remapped image, at 1 byte per pixel, to each row pointed by rows multi-array. 
@@ -109,32 +153,34 @@ func (att *Attributes) WriteRemappedImageBuffer(res *Result, img *Image) (buf []
 // The array must have at least as many elements as height of the image, and each row must have at least as many bytes as width of the image. 
 // Rows must not overlap.
 func (att *Attributes) WriteRemappedImageBufferRows(res *Result, img *Image, rows [][]byte) (rowsOut [][]byte, err error) {
-  if rows == nil { err = ErrInvalidPointer; return }
-  if len(rows) < att.GetImageHeight(img) { err = ErrBufferTooSmall; return }
+  if rows == nil { err = invalidPointer("liq_write_remapped_image_rows"); return }
+  account := att.retainAccount()
+  defer account.release()
+  if !acquireAll(remapLocks(res, img)...) { err = invalidPointer("liq_write_remapped_image_rows"); return }
+  defer releaseAll(remapLocks(res, img)...)
+  const op = "liq_write_remapped_image_rows"
+  width, height := int(C.liq_image_get_width(img.image)), int(C.liq_image_get_height(img.image))
+  if len(rows) < height { err = getImageError(op, C.LIQ_BUFFER_TOO_SMALL, width, height); return }
 
-  rowPtr := make([]*C.uchar, len(rows))
-  width := att.GetImageWidth(img)
+  rowPtr := make([]uintptr, len(rows))
   for i := 0; i < len(rows); i++ {
-    if rows[i] == nil || len(rows[i]) < width { err = ErrBufferTooSmall; return }
-    rowPtr[i] = (*C.uchar)(unsafe.Pointer(&rows[i][0]))
+    if rows[i] == nil || len(rows[i]) < width { err = getImageError(op, C.LIQ_BUFFER_TOO_SMALL, width, height); return }
+    rowPtr[i] = uintptr(unsafe.Pointer(&rows[i][0]))
   }
-  code := C.liq_write_remapped_image_rows(res.result, img.image, (**C.uchar)(unsafe.Pointer(&rowPtr[0])))
+  var code C.liq_error
+  account.run(func() {
+    code = C.liq_write_remapped_image_rows(res.result, img.image, (**C.uchar)(unsafe.Pointer(&rowPtr[0])))
+  })
   rowsOut = rows
-  err = getError(code)
+  err = img.getError(op, code)
   return
 }
 
 // A convenience function that returns a paletted Go Image object.
+//
+// The returned image has the same bounds as the source image (see GetImageBounds).
 func (att *Attributes) WriteRemappedImage(res *Result, img *Image) (imgOut image.Image, err error) {
-  buf, err := att.WriteRemappedImageBuffer(res, img)
-  if err != nil { return }
-
-  pal := att.GetPalette(res)
-  if len(pal) == 0 { err = ErrUnknown; return }
-
-  width, height := att.GetImageWidth(img), att.GetImageHeight(img)
-  imgOut = bytesToPaletted(width, height, pal, buf)
-  return
+  return att.writeRemappedImage(res, img, nil)
 }
 
 
@@ -147,6 +193,8 @@ func (att *Attributes) WriteRemappedImage(res *Result, img *Image) (imgOut image
 // and quality limit hasn't been set, see SetSpeed and SetQuality). The value is not updated when multiple images are remapped, it applies only to the image 
 // used in QuantizeImage or the first image that has been remapped. See GetRemappingError.
 func (att *Attributes) GetQuantizationError(res *Result) float64 {
+  if !res.acquire() { return -1 }
+  defer res.release()
   return float64(C.liq_get_quantization_error(res.result))
 }
 
@@ -154,6 +202,8 @@ func (att *Attributes) GetQuantizationError(res *Result) float64 {
 //
 // It may return -1 if the value is not available (see note in GetQuantizationError).
 func (att *Attributes) GetQuantizationQuality(res *Result) int {
+  if !res.acquire() { return -1 }
+  defer res.release()
   return int(C.liq_get_quantization_quality(res.result))
 }
 
@@ -161,20 +211,124 @@ func (att *Attributes) GetQuantizationQuality(res *Result) int {
 //
 // Alpha channel and gamma correction are taken into account, so the result isn't exactly the mean square error of all channels.
 func (att *Attributes) GetRemappingError(res *Result) float64 {
+  if !res.acquire() { return -1 }
+  defer res.release()
   return float64(C.liq_get_remapping_error(res.result))
 }
 
 // Analoguous to GetRemappingError, but returns quantization error as quality value in the same 0-100 range that is used by SetQuality.
 func (att *Attributes) GetRemappingQuality(res *Result) int {
+  if !res.acquire() { return -1 }
+  defer res.release()
   return int(C.liq_get_remapping_quality(res.result))
 }
 
 
+// Close releases the result. It implements the io.Closer interface and always returns nil.
+//
+// Calling Close more than once has no effect. Close waits for functions using the result in other goroutines to complete.
+// Functions called with a closed result return ErrInvalidPointer, or -1 if they only return a numeric value.
+// Otherwise the result is released by the garbage collector eventually.
+func (res *Result) Close() error {
+  if res == nil { return nil }
+  res.lock.close(func() { freeResult(res) })
+  runtime.SetFinalizer(res, nil)
+  return nil
+}
+
+
+// Used internally. Acquires shared access to the object. Returns false if the object is not available.
+func (res *Result) acquire() bool {
+  return res != nil && res.lock.acquire()
+}
+
+// Used internally. Releases shared access to the object.
+func (res *Result) release() {
+  res.lock.release()
+}
+
+// Used internally. Acquires exclusive access to the object. Returns false if the object is not available.
+func (res *Result) acquireExclusive() bool {
+  return res != nil && res.lock.acquireExclusive()
+}
+
+// Used internally. Releases exclusive access to the object.
+func (res *Result) releaseExclusive() {
+  res.lock.releaseExclusive()
+}
+
+// Used internally. Registers the progress callback function. Exclusive access must be held by the caller.
+func (res *Result) setProgressCallback(cb ProgressCallback) {
+  unregisterCallback(res.progressHandle)
+  res.progress, res.progressHandle = nil, 0
+  if cb != nil {
+    res.progress, res.progressHandle = cb, registerCallback(cb)
+  }
+  C.setResultProgressCallback(res.result, C.uintptr_t(res.progressHandle))
+}
+
+// Used internally. Returns the objects involved in remapping img for acquireAll and releaseAll.
+// Remapping modifies all of them.
+func remapLocks(res *Result, img *Image) []guarded {
+  return []guarded{ exclusive{img}, backgroundLock{img}, exclusive{res} }
+}
+
+// Used internally. Remaps img and returns the palette indices, 1 pixel per byte. Allocations are charged to account.
+// Access to all objects returned by remapLocks must be held by the caller.
+func remapBuffer(account memoryAccount, res *Result, img *Image) (buf []byte, err error) {
+  buf = make([]byte, int(C.liq_image_get_width(img.image)) * int(C.liq_image_get_height(img.image)))
+  var code C.liq_error
+  account.run(func() {
+    code = C.liq_write_remapped_image(res.result, img.image, unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+  })
+  err = img.getError("liq_write_remapped_image", code)
+  return
+}
+
+// Used internally. Implements WriteRemappedImage. The palette is retrieved while the locks for remapping are still held, 
+// so that it matches the remapped pixels. If progress is not nil, it receives the progress callback of res and returns 
+// the callback that is used instead during remapping.
+func (att *Attributes) writeRemappedImage(res *Result, img *Image, progress func(ProgressCallback) ProgressCallback) (imgOut image.Image, err error) {
+  account := att.retainAccount()
+  defer account.release()
+  if !acquireAll(remapLocks(res, img)...) { err = invalidPointer("liq_write_remapped_image"); return }
+  defer releaseAll(remapLocks(res, img)...)
+  if progress != nil {
+    prev := res.progress
+    res.setProgressCallback(progress(prev))
+    defer res.setProgressCallback(prev)
+  }
+
+  buf, err := remapBuffer(account, res, img)
+  if err != nil { return }
+
+  pal := res.palette()
+  if len(pal) == 0 { err = ErrUnknown; return }
+
+  imgOut = bytesToPaletted(img.bounds, pal, buf)
+  return
+}
+
+// Used internally. Completes initialization of a Result object created by the quantization functions.
+func finishResult(res *Result, err error) (*Result, error) {
+  if err != nil {
+    if res.result != nil { C.liq_result_destroy(res.result) }
+    return nil, err
+  }
+  res.lock.open = true
+  liveResults.Add(1)
+  runtime.SetFinalizer(res, freeResult)
+  return res, nil
+}
+
 // Used internally. Frees a Result object.
 func freeResult(r *Result) {
   if r.result != nil {
     // fmt.Println("Releasing Result object.")
     C.liq_result_destroy(r.result)
     r.result = nil
+    liveResults.Add(-1)
+    unregisterCallback(r.progressHandle)
+    r.progress, r.progressHandle = nil, 0
   }
 }
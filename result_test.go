@@ -0,0 +1,66 @@
+package imagequant
+
+import (
+  "image"
+  "sync"
+  "testing"
+)
+
+
+// Remaps several images, some of them with a background image, against one shared result while another goroutine
+// changes the dithering level and closes the result. Run with -race to verify the lock order of remapping
+// (image, background image, result).
+func TestSharedResultStress(t *testing.T) {
+  const workers = 8
+  att := CreateAttributes()
+  defer att.Release()
+  src := gradientImage(32, 32)
+  base, err := att.NewImage(src, 0)
+  if err != nil { t.Fatal(err) }
+  defer base.Close()
+
+  imgs := make([]*Image, 6)
+  for i := range imgs {
+    if imgs[i], err = att.NewImage(src, 0); err != nil { t.Fatal(err) }
+    defer imgs[i].Close()
+  }
+  // images 2 and 3 share image 0 as background, image 5 uses image 4
+  for _, pair := range [][2]int{ { 2, 0 }, { 3, 0 }, { 5, 4 } } {
+    if err = att.SetImageBackground(imgs[pair[0]], imgs[pair[1]]); err != nil { t.Fatal(err) }
+  }
+
+  for round := 0; round < 10; round++ {
+    res, err := att.QuantizeImage(base)
+    if err != nil { t.Fatal(err) }
+    var wg sync.WaitGroup
+    start := make(chan struct{})
+    for w := 0; w < workers; w++ {
+      wg.Add(1)
+      go func(w int) {
+        defer wg.Done()
+        <-start
+        for k := 0; k < 20; k++ {
+          img := imgs[(w + k) % len(imgs)]
+          imgOut, err := att.WriteRemappedImage(res, img)
+          checkLifetimeError(t, "WriteRemappedImage", err)
+          if err != nil { return }
+          pimg := imgOut.(*image.Paletted)
+          for _, v := range pimg.Pix {
+            if int(v) >= len(pimg.Palette) { t.Errorf("palette index %d, %d colors", v, len(pimg.Palette)); return }
+          }
+        }
+      }(w)
+    }
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      <-start
+      for k := 0; k < 10; k++ {
+        checkLifetimeError(t, "SetDitheringLevel", att.SetDitheringLevel(res, float32(k % 3) / 2))
+      }
+      res.Close()
+    }()
+    close(start)
+    wg.Wait()
+  }
+}
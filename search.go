@@ -0,0 +1,195 @@
+package imagequant
+// Search for quantization settings that meet a size or quality constraint.
+
+import (
+  "bytes"
+  "errors"
+  "image"
+  "image/png"
+  "io"
+)
+
+
+// SearchOptions defines the constraints and parameters of SearchImage. At least one of MaxSize and MinQuality must
+// be specified.
+type SearchOptions struct {
+  // MaxSize is the maximum size of the encoded image in bytes. Ignored if 0.
+  MaxSize         int
+  // MinQuality is the minimum remapping quality in range 1-100, see GetRemappingQuality. Ignored if 0.
+  MinQuality      int
+  // DitheringLevels defines the dithering levels to try. Defaults to 1, 0.5 and 0.
+  DitheringLevels []float32
+  // Posterizations defines the posterization values to try, see SetMinPosterization. Defaults to 0 and 2.
+  Posterizations  []int
+  // Encode is used to determine the size of the encoded image. Defaults to png.Encode of the image/png package.
+  Encode          func(w io.Writer, img *image.Paletted) error
+}
+
+// SearchTrial describes a single attempt of SearchImage.
+type SearchTrial struct {
+  MaxColors       int     // See SetMaxColors
+  MaxQuality      int     // Maximum quality of SetQuality. The minimum quality is always 0
+  Posterization   int     // See SetMinPosterization
+  DitheringLevel  float32 // See SetDitheringLevel
+  Size            int     // Size of the encoded image in bytes
+  Quality         int     // Remapping quality in range 0-100, see GetRemappingQuality. -1 if not available
+  Accepted        bool    // Whether the attempt meets all constraints
+}
+
+// SearchResult contains the outcome of SearchImage.
+type SearchResult struct {
+  Image   *image.Paletted // Remapped image of the best attempt. nil if no attempt meets the constraints
+  Data    []byte          // Image encoded by SearchOptions.Encode
+  Best    int             // Index of the best attempt in Trials. -1 if no attempt meets the constraints
+  Trials  []SearchTrial   // All attempts in the order they were performed
+}
+
+
+// Searches for the quantization settings that meet the constraints defined by opts and returns the remapped image
+// together with a log of all attempts.
+//
+// The search is performed for each combination of dithering level and posterization. It first determines the
+// fewest colors (see SetMaxColors) that reach MinQuality. For this number of colors and for each doubled number up to
+// the value of GetMaxColors, the lowest maximum quality (see SetQuality) that still reaches MinQuality is determined.
+// This trades colors against quality, since more colors at a lower maximum quality may result in a smaller image
+// than fewer colors at a higher maximum quality. Of all attempts that meet the constraints, the smallest encoded image
+// is returned. Ties are broken by the higher remapping quality. Without MinQuality this is usually the image with the
+// fewest colors, so MinQuality should be specified as well if image quality matters.
+//
+// img is reused for all attempts. Settings are applied to a copy of the Attributes object, att is not modified.
+//
+// Returns ErrValueOutOfRange if the options are invalid. If no attempt meets the constraints, the result contains
+// the log of all attempts and an error wrapping ErrQualityTooLow is returned.
+func (att *Attributes) SearchImage(img *Image, opts *SearchOptions) (*SearchResult, error) {
+  if img == nil || opts == nil { return nil, invalidPointer("SearchImage") }
+  if opts.MaxSize < 0 || opts.MinQuality < 0 || opts.MinQuality > 100 || (opts.MaxSize == 0 && opts.MinQuality == 0) {
+    return nil, newError("SearchImage", ErrValueOutOfRange, "maximum size %d, minimum quality %d", opts.MaxSize, opts.MinQuality)
+  }
+  s := search{ opts: opts, img: img, encode: opts.Encode, result: &SearchResult{ Best: -1 },
+              trials: make(map[searchKey]SearchTrial) }
+  if s.encode == nil { s.encode = func(w io.Writer, img *image.Paletted) error { return png.Encode(w, img) } }
+  ditheringLevels := opts.DitheringLevels
+  if len(ditheringLevels) == 0 { ditheringLevels = []float32{ 1, 0.5, 0 } }
+  posterizations := opts.Posterizations
+  if len(posterizations) == 0 { posterizations = []int{ 0, 2 } }
+
+  var err error
+  if s.att, err = att.NewCopy(); err != nil { return nil, err }
+  defer s.att.Release()
+  maxColors := s.att.GetMaxColors()
+
+  for _, bits := range posterizations {
+    for _, level := range ditheringLevels {
+      if err = s.searchColors(maxColors, bits, level); err != nil { return nil, err }
+    }
+  }
+
+  if s.result.Best < 0 { return s.result, newError("SearchImage", ErrQualityTooLow, "no settings meet the constraints") }
+  return s.result, nil
+}
+
+
+// Used internally. State of SearchImage.
+type search struct {
+  att     *Attributes
+  img     *Image
+  opts    *SearchOptions
+  encode  func(w io.Writer, img *image.Paletted) error
+  result  *SearchResult
+  trials  map[searchKey]SearchTrial // attempts by settings, to skip repeated attempts
+}
+
+// Used internally. Settings of a single attempt.
+type searchKey struct {
+  colors, maxQuality, bits  int
+  level                     float32
+}
+
+// Used internally. Searches the number of colors and the maximum quality for a single combination of posterization
+// and dithering level.
+func (s *search) searchColors(maxColors, bits int, level float32) error {
+  minQuality := s.opts.MinQuality
+  // fewest colors that reach the minimum quality
+  minColors := 2
+  if minQuality > 0 {
+    i, err := bisect(maxColors - 1, func(i int) (bool, error) {
+      t, err := s.try(2 + i, 100, bits, level)
+      return t.Quality >= minQuality, err
+    })
+    if err != nil || i == maxColors - 1 { return err }
+    minColors += i
+  }
+
+  for colors := minColors; ; colors *= 2 {
+    if colors > maxColors { colors = maxColors }
+    // lowest maximum quality that reaches the minimum quality with this number of colors, which is always the lowest
+    // possible maximum quality without a minimum quality
+    n := 101 - minQuality
+    if minQuality == 0 { n = 1 }
+    _, err := bisect(n, func(i int) (bool, error) {
+      t, err := s.try(colors, minQuality + i, bits, level)
+      return t.Quality >= minQuality, err
+    })
+    if err != nil { return err }
+    if colors == maxColors { return nil }
+  }
+}
+
+// Used internally. Performs a single attempt with the given settings and adds it to the result.
+func (s *search) try(colors, maxQuality, bits int, level float32) (SearchTrial, error) {
+  key := searchKey{ colors, maxQuality, bits, level }
+  if t, ok := s.trials[key]; ok { return t, nil }
+  t := SearchTrial{ MaxColors: colors, MaxQuality: maxQuality, Posterization: bits, DitheringLevel: level, Quality: -1 }
+  imgOut, data, err := s.remap(&t)
+  if err != nil && !errors.Is(err, ErrQualityTooLow) { return t, err }
+  t.Accepted = err == nil && (s.opts.MaxSize == 0 || t.Size <= s.opts.MaxSize) && t.Quality >= s.opts.MinQuality
+  s.result.Trials = append(s.result.Trials, t)
+  s.trials[key] = t
+  if t.Accepted && s.better(t) {
+    s.result.Image, s.result.Data, s.result.Best = imgOut, data, len(s.result.Trials) - 1
+  }
+  return t, nil
+}
+
+// Used internally. Quantizes, remaps and encodes the image with the settings of t, and updates size and quality of t.
+func (s *search) remap(t *SearchTrial) (*image.Paletted, []byte, error) {
+  if err := s.att.SetMaxColors(t.MaxColors); err != nil { return nil, nil, err }
+  if err := s.att.SetQuality(0, t.MaxQuality); err != nil { return nil, nil, err }
+  if err := s.att.SetMinPosterization(t.Posterization); err != nil { return nil, nil, err }
+  res, err := s.att.QuantizeImage(s.img)
+  if err != nil { return nil, nil, err }
+  defer res.Close()
+  if err = s.att.SetDitheringLevel(res, t.DitheringLevel); err != nil { return nil, nil, err }
+  imgOut, err := s.att.WriteRemappedImage(res, s.img)
+  if err != nil { return nil, nil, err }
+  t.Quality = s.att.GetRemappingQuality(res)
+
+  var buf bytes.Buffer
+  if err = s.encode(&buf, imgOut.(*image.Paletted)); err != nil { return nil, nil, err }
+  t.Size = buf.Len()
+  return imgOut.(*image.Paletted), buf.Bytes(), nil
+}
+
+// Used internally. Returns whether the accepted attempt t is better than the best attempt so far.
+func (s *search) better(t SearchTrial) bool {
+  if s.result.Best < 0 { return true }
+  best := s.result.Trials[s.result.Best]
+  return t.Size < best.Size || (t.Size == best.Size && t.Quality > best.Quality)
+}
+
+// Used internally. Calls f for indices in range [0, n) to find the smallest index for which f returns true, assuming
+// that f returns true for all greater indices as well. Returns n if f never returns true. Stops if f returns an error.
+func bisect(n int, f func(i int) (bool, error)) (int, error) {
+  lo, hi := 0, n
+  for lo < hi {
+    mid := int(uint(lo + hi) >> 1)
+    ok, err := f(mid)
+    if err != nil { return lo, err }
+    if ok {
+      hi = mid
+    } else {
+      lo = mid + 1
+    }
+  }
+  return lo, nil
+}
@@ -0,0 +1,99 @@
+package imagequant
+
+import (
+  "bytes"
+  "errors"
+  "image/png"
+  "testing"
+)
+
+
+// Used internally. Runs SearchImage without dithering and posterization with a gradient of 256 colors.
+func searchImage(t *testing.T, maxSize, minQuality int) (*SearchResult, error) {
+  t.Helper()
+  att := CreateAttributes()
+  defer att.Release()
+  img, err := att.NewImage(gradientImage(16, 16), 0)
+  if err != nil { t.Fatal(err) }
+  defer img.Close()
+  opts := &SearchOptions{ MaxSize: maxSize, MinQuality: minQuality, DitheringLevels: []float32{ 0 }, Posterizations: []int{ 0 } }
+  return att.SearchImage(img, opts)
+}
+
+// Used internally. Checks whether the result is the smallest accepted attempt and whether all attempts are marked
+// correctly.
+func checkSearchResult(t *testing.T, res *SearchResult, maxSize, minQuality int) {
+  t.Helper()
+  if res.Best < 0 || res.Image == nil { t.Fatalf("got no result, %d attempts", len(res.Trials)) }
+  best := res.Trials[res.Best]
+  if best.Size != len(res.Data) { t.Errorf("got size %d of best attempt, %d bytes of data", best.Size, len(res.Data)) }
+  if best.Quality < minQuality { t.Errorf("got quality %d, want at least %d", best.Quality, minQuality) }
+  if maxSize > 0 && best.Size > maxSize { t.Errorf("got size %d, want at most %d", best.Size, maxSize) }
+  for i, tr := range res.Trials {
+    if accepted := (maxSize == 0 || tr.Size <= maxSize) && tr.Quality >= minQuality; tr.Accepted != accepted {
+      t.Errorf("attempt %d %+v: got accepted %v", i, tr, tr.Accepted)
+    }
+    if tr.Accepted && tr.Size < best.Size { t.Errorf("attempt %d %+v is smaller than best attempt %+v", i, tr, best) }
+  }
+  img, err := png.Decode(bytes.NewReader(res.Data))
+  if err != nil { t.Fatal(err) }
+  if img.Bounds() != res.Image.Bounds() { t.Errorf("got bounds %v of data, %v of image", img.Bounds(), res.Image.Bounds()) }
+}
+
+
+func TestSearchImageQuality(t *testing.T) {
+  res, err := searchImage(t, 0, 50)
+  if err != nil { t.Fatal(err) }
+  checkSearchResult(t, res, 0, 50)
+
+  // both the number of colors and the maximum quality must be searched
+  colors, qualities := make(map[int]bool), make(map[int]bool)
+  for _, tr := range res.Trials { colors[tr.MaxColors], qualities[tr.MaxQuality] = true, true }
+  if len(colors) < 2 || len(qualities) < 2 {
+    t.Errorf("got %d color counts and %d maximum qualities in %d attempts", len(colors), len(qualities), len(res.Trials))
+  }
+}
+
+func TestSearchImageSize(t *testing.T) {
+  // target size is the result of a fixed number of colors
+  att := CreateAttributes()
+  defer att.Release()
+  if err := att.SetMaxColors(16); err != nil { t.Fatal(err) }
+  img, err := att.NewImage(gradientImage(16, 16), 0)
+  if err != nil { t.Fatal(err) }
+  defer img.Close()
+  qres, err := att.QuantizeImage(img)
+  if err != nil { t.Fatal(err) }
+  defer qres.Close()
+  if err = att.SetDitheringLevel(qres, 0); err != nil { t.Fatal(err) }
+  imgOut, err := att.WriteRemappedImage(qres, img)
+  if err != nil { t.Fatal(err) }
+  var buf bytes.Buffer
+  if err = png.Encode(&buf, imgOut); err != nil { t.Fatal(err) }
+  maxSize := buf.Len()
+
+  res, err := searchImage(t, maxSize, 0)
+  if err != nil { t.Fatal(err) }
+  checkSearchResult(t, res, maxSize, 0)
+  if best := res.Trials[res.Best]; best.MaxColors > 16 { t.Errorf("got %d colors, want at most 16 for smallest result", best.MaxColors) }
+}
+
+func TestSearchImageSizeAndQuality(t *testing.T) {
+  res, err := searchImage(t, 0, 50)
+  if err != nil { t.Fatal(err) }
+  size := res.Trials[res.Best].Size
+
+  // the smallest image of the required quality just fits
+  res, err = searchImage(t, size, 50)
+  if err != nil { t.Fatal(err) }
+  checkSearchResult(t, res, size, 50)
+  if got := res.Trials[res.Best].Size; got != size { t.Errorf("got size %d, want %d", got, size) }
+
+  // no attempt can be accepted
+  res, err = searchImage(t, size - 1, 50)
+  var qerr *Error
+  if !errors.Is(err, ErrQualityTooLow) || !errors.As(err, &qerr) { t.Fatalf("got %v, want *Error wrapping ErrQualityTooLow", err) }
+  if res.Best != -1 || res.Image != nil || len(res.Trials) == 0 {
+    t.Errorf("got best attempt %d, image %v, %d attempts", res.Best, res.Image != nil, len(res.Trials))
+  }
+}
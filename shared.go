@@ -0,0 +1,92 @@
+package imagequant
+// Quantization of multiple images to a shared palette.
+
+import (
+  "bytes"
+  "fmt"
+  "image"
+  "image/color"
+
+  "github.com/InfinityTools/go-imagequant/internal/palette"
+)
+
+
+// SharedOptions defines optional parameters of QuantizeShared.
+type SharedOptions struct {
+  // Weights defines the importance of each image for palette generation, in range 0 (ignored) to 1 (default).
+  // Must be nil or contain one entry for each image.
+  Weights         []float32
+  // DitheringLevel is used when remapping images. See SetDitheringLevel. A zero value disables dithering; set it to
+  // 1.0 for the library default.
+  DitheringLevel  float32
+}
+
+// SharedResult contains the images created by QuantizeShared.
+type SharedResult struct {
+  Palette   color.Palette     // The palette shared by all images
+  Images    []*image.Paletted // Remapped images in the order of the source images. All of them refer to Palette
+  Quality   []int             // Remapping quality of each image in range 0-100, see GetRemappingQuality. -1 if not available
+}
+
+
+// Generates a single palette for all given images and remaps each image to it. This is useful for animations,
+// sprite sheets and other images that should be displayed with the same palette.
+//
+// Colors of all images are collected in a single histogram. Images with a greater weight (see SharedOptions) have a
+// greater influence on the palette. Default options are used if opts is nil.
+//
+// Returns ErrInvalidPointer if images is empty and ErrValueOutOfRange if the weights are invalid. Errors concerning a
+// specific image include the index of the image.
+func (att *Attributes) QuantizeShared(images []image.Image, opts *SharedOptions) (*SharedResult, error) {
+  if len(images) == 0 { return nil, invalidPointer("QuantizeShared") }
+  if opts == nil { opts = &SharedOptions{} }
+  if opts.Weights != nil {
+    if len(opts.Weights) != len(images) {
+      return nil, newError("QuantizeShared", ErrValueOutOfRange, "%d weights for %d images", len(opts.Weights), len(images))
+    }
+    for i, w := range opts.Weights {
+      if w < 0 || w > 1 { return nil, newError("QuantizeShared", ErrValueOutOfRange, "weight %g of image %d not in range [0, 1]", w, i) }
+    }
+  }
+
+  hist, err := att.NewHistogram()
+  if err != nil { return nil, err }
+  defer hist.Close()
+
+  qimgs := make([]*Image, len(images))
+  defer func() {
+    for _, qimg := range qimgs { qimg.Close() }
+  }()
+  for i, img := range images {
+    if img == nil { return nil, fmt.Errorf("image %d: %w", i, invalidPointer("QuantizeShared")) }
+    if qimgs[i], err = att.NewImage(img, 0.0); err != nil { return nil, fmt.Errorf("image %d: %w", i, err) }
+    if opts.Weights != nil {
+      // the library treats importance 255 like a pixel without importance map
+      weight := byte(opts.Weights[i] * 255 + 0.5)
+      importance := bytes.Repeat([]byte{ weight }, img.Bounds().Dx() * img.Bounds().Dy())
+      if err = att.SetImageImportanceMap(qimgs[i], importance); err != nil { return nil, fmt.Errorf("image %d: %w", i, err) }
+    }
+    if err = att.AddImageToHistogram(hist, qimgs[i]); err != nil { return nil, fmt.Errorf("image %d: %w", i, err) }
+  }
+
+  res, err := att.QuantizeHistogram(hist)
+  if err != nil { return nil, err }
+  defer res.Close()
+  if err = att.SetDitheringLevel(res, opts.DitheringLevel); err != nil { return nil, err }
+
+  retVal := &SharedResult{
+    Palette: att.GetPalette(res),
+    Images:  make([]*image.Paletted, len(images)),
+    Quality: make([]int, len(images)),
+  }
+  for i, qimg := range qimgs {
+    imgOut, err := att.WriteRemappedImage(res, qimg)
+    if err != nil { return nil, fmt.Errorf("image %d: %w", i, err) }
+    pimg := imgOut.(*image.Paletted)
+    // palette may be refined during remapping
+    palette.Convert(pimg, retVal.Palette)
+    retVal.Images[i] = pimg
+    retVal.Quality[i] = att.GetRemappingQuality(res)
+  }
+  return retVal, nil
+}